@@ -25,7 +25,7 @@ import (
 	"runtime/pprof"
 	"strings"
 )
-import algocommon "github.com/jkaiser/dedup_simulations/dedupAlgorithms/common"
+import "github.com/jkaiser/dedup_tools/parser"
 import log "github.com/cihub/seelog"
 
 func setupLogger(debug bool) {
@@ -149,61 +149,36 @@ func writeResultsZeroOne(results Results, resultsFile string) {
 	}
 }
 
-func processFile(inFile string, chunkIndex map[[12]byte]int32, specialChunks map[string]string) (map[[12]byte]int32, Results) {
+func processEntry(fileEntry *parser.FileEntry, chunkIndex map[[12]byte]int32, zeroChunk, oneChunk []byte, res *Results) {
 
-	var res Results
-	var chunkHashBuf [12]byte // Used to make the Digest useable in maps.
-	fileEntryChan := make(chan *algocommon.FileEntry, algocommon.ConstMaxFileEntries)
+	var chunkHashBuf [12]byte // Used to make the fingerprint useable in maps.
 
-	// setup zero and one-chunks
-	var zeroChunk, oneChunk []byte
-	var err error
-	zeroChunk, err = hex.DecodeString(specialChunks["zero"])
-	if err != nil {
-		panic(err)
-	}
-	oneChunk, err = hex.DecodeString(specialChunks["one"])
-	if err != nil {
-		panic(err)
+	log.Info("processing traced file ", fileEntry.File.GetFilename())
+	if !strings.HasSuffix(fileEntry.File.GetFilename(), "dmtcp") {
+		log.Debugf("skip traced file %v", fileEntry.File.GetFilename())
+		return
 	}
 
-	// generate traceDataReader
-	log.Debug("generate TraceDataReader for path: ", inFile)
-	tReader := algocommon.NewTraceDataReader(inFile)
-	go tReader.FeedAlgorithm(fileEntryChan)
-
-	// perform the refcounting
-	for fileEntry := range fileEntryChan {
-
-        log.Info("processing traced file ", fileEntry.TracedFile.Filename)
-		if !strings.HasSuffix(fileEntry.TracedFile.Filename, "dmtcp") {
-			log.Debugf("skip traced file %v", fileEntry.TracedFile.Filename)
-			tReader.GetFileEntryReturn() <- fileEntry
-			continue
+	for i := range fileEntry.Chunks {
+		copy(chunkHashBuf[:], fileEntry.Chunks[i].Fp)
+		if numOcc, ok := chunkIndex[chunkHashBuf]; ok { // old entry
+			chunkIndex[chunkHashBuf] = numOcc + 1
+		} else {
+			chunkIndex[chunkHashBuf] = 1
 		}
 
-		for i := range fileEntry.Chunks {
-			copy(chunkHashBuf[:], fileEntry.Chunks[i].Digest)
-			if numOcc, ok := chunkIndex[chunkHashBuf]; ok { // old entry
-				chunkIndex[chunkHashBuf] = numOcc + 1
-			} else {
-				chunkIndex[chunkHashBuf] = 1
-			}
-
-			// check for special chunks
-			if bytes.Equal(chunkHashBuf[:], zeroChunk) {
-				res.NumChunksZero++
-			} else if bytes.Equal(chunkHashBuf[:], oneChunk) {
-				res.NumChunksOne++
-			}
+		// check for special chunks
+		if bytes.Equal(chunkHashBuf[:], zeroChunk) {
+			res.NumChunksZero++
+		} else if bytes.Equal(chunkHashBuf[:], oneChunk) {
+			res.NumChunksOne++
 		}
-		tReader.GetFileEntryReturn() <- fileEntry
 	}
-
-	return chunkIndex, res
 }
 
-func computeSkewness(inFiles []string) ([]int32, Results) {
+// parses the traces with the given number of concurrent workers. Each trace
+// is split into up to ranges parts that are parsed concurrently.
+func computeSkewness(inFiles []string, workers, ranges int) ([]int32, Results) {
 
 	var specialChunksMap map[string]map[string]string = make(map[string]map[string]string)
 	specialChunksMap["cdc4"] = map[string]string{"zero": "897256b6709e1a4da9daba92", "one": "95e00e7bbef9a74788304629"}
@@ -215,10 +190,12 @@ func computeSkewness(inFiles []string) ([]int32, Results) {
 	specialChunksMap["fixed16"] = map[string]string{"zero": "897256b6709e1a4da9daba92", "one": "547372f1044a3442aa52fcd2"}
 	specialChunksMap["fixed32"] = map[string]string{"zero": "5188431849b4613152fd7bdb", "one": "ca711c69165e1fa5be72993b"}
 
-	var res, tmpResult Results
+	var res Results
 
-	var chunkIndex map[[12]byte]int32 = make(map[[12]byte]int32, 1e6)
-	for _, inFile := range inFiles {
+	// setup zero and one-chunks per trace
+	zeroChunks := make([][]byte, len(inFiles))
+	oneChunks := make([][]byte, len(inFiles))
+	for i, inFile := range inFiles {
 		specialChMapToUse := specialChunksMap["cdc8"] // cdc8 per default
 		for k, v := range specialChunksMap {
 			if strings.Contains(inFile, k) {
@@ -226,10 +203,32 @@ func computeSkewness(inFiles []string) ([]int32, Results) {
 				break
 			}
 		}
-		log.Infof("Start processing file %v. So far we have %v different chunks", inFile, len(chunkIndex))
-		chunkIndex, tmpResult = processFile(inFile, chunkIndex, specialChMapToUse)
-		res.Add(&tmpResult)
+
+		var err error
+		if zeroChunks[i], err = hex.DecodeString(specialChMapToUse["zero"]); err != nil {
+			panic(err)
+		}
+		if oneChunks[i], err = hex.DecodeString(specialChMapToUse["one"]); err != nil {
+			panic(err)
+		}
+	}
+
+	// the traces are parsed concurrently, but processed one record at a time
+	var chunkIndex map[[12]byte]int32 = make(map[[12]byte]int32, 1e6)
+	records := make(chan *parser.Record, parser.ConstMaxFileEntries)
+	errChan := make(chan []error, 1)
+	go func() {
+		errChan <- parser.ParseAll(inFiles, parser.PipelineOptions{Format: parser.FormatProto, Workers: workers, Ranges: ranges}, records)
+	}()
+	for r := range records {
+		processEntry(r.Entry, chunkIndex, zeroChunks[r.Trace], oneChunks[r.Trace], &res)
+	}
+	for i, err := range <-errChan {
+		if err != nil {
+			log.Error("Couldn't read the whole trace ", inFiles[i], ": ", err)
+		}
 	}
+	log.Infof("Processed %v files. We have %v different chunks", len(inFiles), len(chunkIndex))
 
 	var max int32
 	for _, refCnt := range chunkIndex {
@@ -257,7 +256,6 @@ func computeSkewness(inFiles []string) ([]int32, Results) {
 }
 
 func main() {
-	runtime.GOMAXPROCS(2)
 	defer log.Flush()
 	var descr string = `   This program computes the chunk skewness, i.e. the number of chunks that occur exactly N times.
    Example:
@@ -279,6 +277,8 @@ func main() {
 	in_files := flag.String("traces", "", "The COMMA-SEPERATED list of trace files to consider.")
 	resultsFile := flag.String("out", "out", "The output file.")
 	zeroOneOutFile := flag.String("zeroOneStats", "zeroOneStats.json", "The output file for the zero-chunk/one-chunk statistics.")
+	workers := flag.Int("workers", runtime.NumCPU(), "The number of traces or trace parts parsed concurrently.")
+	ranges := flag.Int("ranges", 1, "Splits each uncompressed trace into this many parts that are parsed concurrently. Only traces indexed by fsc_index are split.")
 
 	debug := flag.Bool("debug", false, "Enables full debug output.")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
@@ -302,7 +302,7 @@ func main() {
 		panic("Found no valid input file in the list of given ones.")
 	}
 
-	refs, zeroOneStats := computeSkewness(inputFiles)
+	refs, zeroOneStats := computeSkewness(inputFiles, *workers, *ranges)
 
 	writeResults(refs, *resultsFile)
 	writeResultsZeroOne(zeroOneStats, *zeroOneOutFile)
@@ -3,12 +3,12 @@ package main
 import "testing"
 import "os"
 import "github.com/gogo/protobuf/proto"
-import "github.com/jkaiser/dedup_simulations/de_pc2_dedup_fschunk"
+import "github.com/jkaiser/dedup_tools/traceProto"
 
 func protoParseTestInit(t *testing.T) map[string]string {
 	// create first testdata
 
-	f := new(de_pc2_dedup_fschunk.File)
+	f := new(traceProto.File)
 	f.Filename = proto.String("filename A.dmtcp")
 	f.Fsize = proto.Uint64(42)
 	f.Label = proto.String("label A")
@@ -49,7 +49,7 @@ func protoParseTestInit(t *testing.T) map[string]string {
 	testfile.Write(buf)
 
 	for i := 0; i < 4; i++ {
-		c := new(de_pc2_dedup_fschunk.Chunk)
+		c := new(traceProto.Chunk)
 		fp := make([]byte, 10)
 		fp[0] = byte(i)
 		c.Fp = fp
@@ -66,7 +66,7 @@ func protoParseTestInit(t *testing.T) map[string]string {
 	}
 
 	// the last chunk appears two times:
-	c := new(de_pc2_dedup_fschunk.Chunk)
+	c := new(traceProto.Chunk)
 	fp := make([]byte, 10)
 	fp[0] = byte(0)
 	c.Fp = fp
@@ -89,7 +89,7 @@ func protoParseTestInit(t *testing.T) map[string]string {
 func TestComputeSkewEmptyFile(t *testing.T) {
 	testdata := protoParseTestInit(t)
 
-	refs, _ := computeSkewness([]string{testdata["emptyFile"]})
+	refs, _ := computeSkewness([]string{testdata["emptyFile"]}, 2, 1)
 	if len(refs) > 1 {
 		t.Fatalf("Empty file returned too big refcnt list: expected: 1 entrie, got : %v entries: %v", len(refs), refs)
 	}
@@ -98,7 +98,7 @@ func TestComputeSkewEmptyFile(t *testing.T) {
 func TestComputeSkew5Chunks(t *testing.T) {
 	testdata := protoParseTestInit(t)
 
-	refs, _ := computeSkewness([]string{testdata["FileWith5Chunks"]})
+	refs, _ := computeSkewness([]string{testdata["FileWith5Chunks"]}, 2, 1)
 	if len(refs) != 3 {
 		t.Fatalf("Wrong length of refcnt list. expected: %v; got: %v entries %v", 3, len(refs), refs)
 	} else if refs[1] != 3 {
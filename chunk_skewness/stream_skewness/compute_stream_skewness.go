@@ -23,7 +23,7 @@ import (
 	"runtime/pprof"
 	"strings"
 )
-import algocommon "github.com/jkaiser/dedup_simulations/dedupAlgorithms/common"
+import "github.com/jkaiser/dedup_tools/parser"
 import log "github.com/cihub/seelog"
 
 type StreamStats struct {
@@ -124,57 +124,57 @@ func writeResults(refCounter []int32, refOccurrences []uint32, refVolumes []int6
 	}
 }
 
-func processFile(inFile string, chunkIndex map[[12]byte]map[string]*StreamStats) map[[12]byte]map[string]*StreamStats {
+func processEntry(fileEntry *parser.FileEntry, chunkIndex map[[12]byte]map[string]*StreamStats) {
 
-	var chunkHashBuf [12]byte // Used to make the Digest useable in maps.
-	fileEntryChan := make(chan *algocommon.FileEntry, algocommon.ConstMaxFileEntries)
+	var chunkHashBuf [12]byte // Used to make the fingerprint useable in maps.
 
-	// generate traceDataReader
-	log.Debug("generate TraceDataReader for path: ", inFile)
-	tReader := algocommon.NewTraceDataReader(inFile)
-	go tReader.FeedAlgorithm(fileEntryChan)
-
-	for fileEntry := range fileEntryChan {
-
-		if !strings.HasSuffix(fileEntry.TracedFile.Filename, "dmtcp") {
-			log.Debugf("skip traced file %v", fileEntry.TracedFile.Filename)
-			tReader.GetFileEntryReturn() <- fileEntry
-			continue
-		}
+	if !strings.HasSuffix(fileEntry.File.GetFilename(), "dmtcp") {
+		log.Debugf("skip traced file %v", fileEntry.File.GetFilename())
+		return
+	}
 
-		var streamID string = path.Base(fileEntry.TracedFile.Filename)
+	var streamID string = path.Base(fileEntry.File.GetFilename())
 
-		for i := range fileEntry.Chunks {
-			copy(chunkHashBuf[:], fileEntry.Chunks[i].Digest)
+	for i := range fileEntry.Chunks {
+		copy(chunkHashBuf[:], fileEntry.Chunks[i].Fp)
 
-			if ciEntry, ok := chunkIndex[chunkHashBuf]; ok { // old entry
+		if ciEntry, ok := chunkIndex[chunkHashBuf]; ok { // old entry
 
-				if sstats, ok := ciEntry[streamID]; ok {
-					sstats.numberOfOccurrences++
-					sstats.volume += int64(fileEntry.Chunks[i].Size)
-				} else {
-					ciEntry[streamID] = &StreamStats{volume: int64(fileEntry.Chunks[i].Size), numberOfOccurrences: 1}
-				}
+			if sstats, ok := ciEntry[streamID]; ok {
+				sstats.numberOfOccurrences++
+				sstats.volume += int64(fileEntry.Chunks[i].GetCsize())
 			} else {
-				m := make(map[string]*StreamStats)
-				m[streamID] = &StreamStats{volume: int64(fileEntry.Chunks[i].Size), numberOfOccurrences: 1}
-				chunkIndex[chunkHashBuf] = m
+				ciEntry[streamID] = &StreamStats{volume: int64(fileEntry.Chunks[i].GetCsize()), numberOfOccurrences: 1}
 			}
+		} else {
+			m := make(map[string]*StreamStats)
+			m[streamID] = &StreamStats{volume: int64(fileEntry.Chunks[i].GetCsize()), numberOfOccurrences: 1}
+			chunkIndex[chunkHashBuf] = m
 		}
-
-		tReader.GetFileEntryReturn() <- fileEntry
 	}
-
-	return chunkIndex
 }
 
-func computeSkewness(inFiles []string) ([]int32, []uint32, []int64) {
+// parses the traces with the given number of concurrent workers. Each trace
+// is split into up to ranges parts that are parsed concurrently.
+func computeSkewness(inFiles []string, workers, ranges int) ([]int32, []uint32, []int64) {
 
 	chunkIndex := make(map[[12]byte]map[string]*StreamStats, 1e6) // holds for each fp a map. This map contains all streamIDs of all streams which contain that chunk/fp
-	for _, file := range inFiles {
-		log.Infof("Start processing file %v. So far we have %v different chunks", file, len(chunkIndex))
-		chunkIndex = processFile(file, chunkIndex)
+
+	// the traces are parsed concurrently, but processed one record at a time
+	records := make(chan *parser.Record, parser.ConstMaxFileEntries)
+	errChan := make(chan []error, 1)
+	go func() {
+		errChan <- parser.ParseAll(inFiles, parser.PipelineOptions{Format: parser.FormatProto, Workers: workers, Ranges: ranges}, records)
+	}()
+	for r := range records {
+		processEntry(r.Entry, chunkIndex)
+	}
+	for i, err := range <-errChan {
+		if err != nil {
+			log.Error("Couldn't read the whole trace ", inFiles[i], ": ", err)
+		}
 	}
+	log.Infof("Processed %v files. We have %v different chunks", len(inFiles), len(chunkIndex))
 
 	var max int
 	for _, ciEntry := range chunkIndex {
@@ -201,7 +201,6 @@ func computeSkewness(inFiles []string) ([]int32, []uint32, []int64) {
 
 // This program will look for fileentries in the given trace files and only consider those which end with "TODO".
 func main() {
-	runtime.GOMAXPROCS(2)
 	defer log.Flush()
 
 	var descr string = `   This program computes the stream skewness, i.e. how many chunks occur in exaclty  N streams.
@@ -224,6 +223,8 @@ func main() {
 
 	in_files := flag.String("traces", "", "The COMMA-SEPERATED list of trace files to consider.")
 	resultsFile := flag.String("out", "out", "The output file.")
+	workers := flag.Int("workers", runtime.NumCPU(), "The number of traces or trace parts parsed concurrently.")
+	ranges := flag.Int("ranges", 1, "Splits each uncompressed trace into this many parts that are parsed concurrently. Only traces indexed by fsc_index are split.")
 
 	debug := flag.Bool("debug", false, "Enables full debug output.")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
@@ -247,7 +248,7 @@ func main() {
 		panic("Found no valid input file in the list of given ones.")
 	}
 
-	refs, refsOccurrences, refsVolumes := computeSkewness(fileList)
+	refs, refsOccurrences, refsVolumes := computeSkewness(fileList, *workers, *ranges)
 
 	writeResults(refs, refsOccurrences, refsVolumes, *resultsFile)
 }
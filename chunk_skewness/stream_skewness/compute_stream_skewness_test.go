@@ -2,13 +2,15 @@ package main
 
 import "testing"
 import "os"
+import "fmt"
 import "github.com/gogo/protobuf/proto"
-import "github.com/jkaiser/dedup_simulations/de_pc2_dedup_fschunk"
+import "github.com/jkaiser/dedup_tools/parser"
+import "github.com/jkaiser/dedup_tools/traceProto"
 
 func protoParseTestInit(t *testing.T) map[string]string {
 	// create first testdata
 
-	f := new(de_pc2_dedup_fschunk.File)
+	f := new(traceProto.File)
 	f.Filename = proto.String("filename A")
 	f.Fsize = proto.Uint64(42)
 	f.Label = proto.String("label A")
@@ -50,7 +52,7 @@ func protoParseTestInit(t *testing.T) map[string]string {
 	testfile.Write(buf)
 
 	for i := 0; i < 4; i++ {
-		c := new(de_pc2_dedup_fschunk.Chunk)
+		c := new(traceProto.Chunk)
 		fp := make([]byte, 10)
 		fp[0] = byte(i)
 		c.Fp = fp
@@ -78,7 +80,7 @@ func protoParseTestInit(t *testing.T) map[string]string {
 	testfile.Write(buf)
 
 	// the last chunk appears two times:
-	c := new(de_pc2_dedup_fschunk.Chunk)
+	c := new(traceProto.Chunk)
 	fp := make([]byte, 10)
 	fp[0] = byte(0)
 	c.Fp = fp
@@ -103,7 +105,7 @@ func protoParseTestInit(t *testing.T) map[string]string {
 func TestComputeSkewEmptyFile(t *testing.T) {
 	testdata := protoParseTestInit(t)
 
-	refs := computeSkewness([]string{testdata["emptyFile"]})
+	refs, _, _ := computeSkewness([]string{testdata["emptyFile"]}, 2, 1)
 	if len(refs) > 1 {
 		t.Fatalf("Empty file returned too big streamcnt list: expected: 1 entry, got : %v entries: %v", len(refs), refs)
 	}
@@ -112,7 +114,7 @@ func TestComputeSkewEmptyFile(t *testing.T) {
 func TestComputeSkew6Chunks(t *testing.T) {
 	testdata := protoParseTestInit(t)
 
-	refs := computeSkewness([]string{testdata["FileWith6Chunks"]})
+	refs, _, _ := computeSkewness([]string{testdata["FileWith6Chunks"]}, 2, 1)
 	if len(refs) != 3 {
 		t.Fatalf("Wrong length of refcnt list. expected: %v; got: %v entries %v", 3, len(refs), refs)
 	} else if refs[1] != 3 {
@@ -125,7 +127,7 @@ func TestComputeSkew6Chunks(t *testing.T) {
 func TestComputeSkewDoubleFiles(t *testing.T) {
 	testdata := protoParseTestInit(t)
 
-	refs := computeSkewness([]string{testdata["FileWith6Chunks"], testdata["FileWith6Chunks"]})
+	refs, _, _ := computeSkewness([]string{testdata["FileWith6Chunks"], testdata["FileWith6Chunks"]}, 2, 1)
 	if len(refs) != 3 {
 		t.Fatalf("Wrong length of refcnt list. expected: %v; got: %v entries %v", 3, len(refs), refs)
 	} else if refs[1] != 3 {
@@ -134,3 +136,21 @@ func TestComputeSkewDoubleFiles(t *testing.T) {
 		t.Fatalf("Wrong refcount for 2 occurrences. expected: %v; got: %v", 1, refs[2])
 	}
 }
+
+func TestComputeSkewRanges(t *testing.T) {
+	testdata := protoParseTestInit(t)
+
+	// splitting the traces must not change the result
+	inFiles := []string{testdata["FileWith6Chunks"], testdata["FileWith6Chunks"]}
+	refs, occurrences, volumes := computeSkewness(inFiles, 2, 1)
+
+	// only indexed traces are split
+	if _, err := parser.IndexProtoFile(inFiles[0], inFiles[0]+parser.IndexSuffix, 1); err != nil {
+		t.Fatalf("Couldn't index trace: %v", err)
+	}
+	defer os.Remove(inFiles[0] + parser.IndexSuffix)
+	splitRefs, splitOccurrences, splitVolumes := computeSkewness(inFiles, 2, 4)
+	if fmt.Sprint(refs, occurrences, volumes) != fmt.Sprint(splitRefs, splitOccurrences, splitVolumes) {
+		t.Fatalf("Results differ: %v %v %v vs. %v %v %v", refs, occurrences, volumes, splitRefs, splitOccurrences, splitVolumes)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import "fmt"
+import "flag"
+import "os"
+import "io"
+import "path/filepath"
+import "runtime"
+import "sort"
+import "strconv"
+import "strings"
+import "text/tabwriter"
+import "encoding/json"
+
+import log "github.com/cihub/seelog"
+import "github.com/jkaiser/dedup_tools/parser"
+
+// setupLogger makes seelog write to stderr, as stdout may carry the report.
+func setupLogger(debug bool) {
+	var level log.LogLevel = log.InfoLvl
+	if debug {
+		level = log.DebugLvl
+	}
+	if logger, err := log.LoggerFromWriterWithMinLevelAndFormat(os.Stderr, level, "%Date %Time [%Level] %Msg%n"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else if loggerErr := log.ReplaceLogger(logger); loggerErr != nil {
+		fmt.Fprintln(os.Stderr, loggerErr)
+	}
+}
+
+// DedupStats are the results of exact deduplication with a full chunk index.
+// The bytes are the summed up chunk sizes.
+type DedupStats struct {
+	Chunks       uint64
+	UniqueChunks uint64 // chunks not seen before in the series
+	LogicalBytes uint64
+	UniqueBytes  uint64
+	DedupRatio   float64 // logical bytes / unique bytes
+	NewData      float64 // fraction of the logical bytes that is unique
+}
+
+// TraceResult are the deduplication statistics of a trace of the series and
+// of all traces up to and including it. They are encoded as JSON.
+type TraceResult struct {
+	Trace      string
+	Stats      DedupStats
+	Cumulative DedupStats
+	Error      string `json:",omitempty"`
+}
+
+func (s *DedupStats) add(that DedupStats) {
+	s.Chunks += that.Chunks
+	s.UniqueChunks += that.UniqueChunks
+	s.LogicalBytes += that.LogicalBytes
+	s.UniqueBytes += that.UniqueBytes
+}
+
+// finish computes the ratios.
+func (s *DedupStats) finish() {
+	if s.UniqueBytes > 0 {
+		s.DedupRatio = float64(s.LogicalBytes) / float64(s.UniqueBytes)
+	}
+	if s.LogicalBytes > 0 {
+		s.NewData = float64(s.UniqueBytes) / float64(s.LogicalBytes)
+	}
+}
+
+func processEntry(fileEntry *parser.FileEntry, chunkIndex map[[12]byte]struct{}, stats *DedupStats) {
+
+	for _, c := range fileEntry.Chunks {
+		// Used to make the fingerprint useable in maps. Cleared per chunk, so
+		// shorter fingerprints don't keep bytes of the previous one.
+		var chunkHashBuf [12]byte
+		copy(chunkHashBuf[:], c.Fp)
+		stats.Chunks++
+		stats.LogicalBytes += uint64(c.GetCsize())
+
+		if _, ok := chunkIndex[chunkHashBuf]; !ok {
+			chunkIndex[chunkHashBuf] = struct{}{}
+			stats.UniqueChunks++
+			stats.UniqueBytes += uint64(c.GetCsize())
+		}
+	}
+}
+
+// deduplicates the traces in the given order against a single chunk index.
+// Up to workers traces or trace parts are parsed concurrently, each trace is
+// split into up to ranges parts. Returns whether all traces were read
+// completely.
+func computeDedup(traces []string, workers, ranges int) ([]*TraceResult, bool) {
+	chunkIndex := make(map[[12]byte]struct{}, 1e6)
+	results := make([]*TraceResult, len(traces))
+	for i, trace := range traces {
+		results[i] = &TraceResult{Trace: trace}
+	}
+
+	// the records arrive trace by trace, so each chunk is unique in the first
+	// trace that contains it
+	records := make(chan *parser.Record, parser.ConstMaxFileEntries)
+	errChan := make(chan []error, 1)
+	go func() {
+		options := parser.PipelineOptions{Format: parser.FormatProto, Workers: workers, Ranges: ranges, Ordered: true}
+		errChan <- parser.ParseAll(traces, options, records)
+	}()
+	for r := range records {
+		processEntry(r.Entry, chunkIndex, &results[r.Trace].Stats)
+	}
+
+	complete := true
+	for i, err := range <-errChan {
+		if err != nil {
+			log.Error("Couldn't read the whole trace ", traces[i], ": ", err)
+			results[i].Error = err.Error()
+			complete = false
+		}
+	}
+	log.Infof("Processed %v traces. We have %v different chunks", len(traces), len(chunkIndex))
+
+	var cumulative DedupStats
+	for _, r := range results {
+		cumulative.add(r.Stats)
+		r.Cumulative = cumulative
+		r.Stats.finish()
+		r.Cumulative.finish()
+	}
+	return results, complete
+}
+
+// generatorPlan is the part of the plan.txt written by the generator that
+// lists the generated traces.
+type generatorPlan struct {
+	Plan map[string][]struct {
+		TargetFile string
+	}
+}
+
+// readPlan returns the traces of the generator plan at planPath ordered by
+// day and, within a day, in the order of the plan. Traces that don't exist at the path given
+// in the plan are looked up in the directory of the plan.
+func readPlan(planPath string) ([]string, error) {
+	f, err := os.Open(planPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var plan generatorPlan
+	if err := json.NewDecoder(f).Decode(&plan); err != nil {
+		return nil, fmt.Errorf("couldn't decode plan %v: %v", planPath, err)
+	}
+
+	days := make([]int, 0, len(plan.Plan))
+	for d := range plan.Plan {
+		day, err := strconv.Atoi(d)
+		if err != nil {
+			return nil, fmt.Errorf("plan %v: invalid day %q", planPath, d)
+		}
+		days = append(days, day)
+	}
+	sort.Ints(days)
+
+	traces := make([]string, 0)
+	for _, day := range days {
+		for _, p := range plan.Plan[strconv.Itoa(day)] {
+			name := p.TargetFile
+			if _, err := os.Stat(name); err != nil {
+				name = filepath.Join(filepath.Dir(planPath), filepath.Base(name))
+			}
+			traces = append(traces, name)
+		}
+	}
+	return traces, nil
+}
+
+// writes a table with a row per trace.
+func writeText(w io.Writer, results []*TraceResult) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "trace\tchunks\tunique chunks\tlogical bytes\tunique bytes\tdedup ratio\tnew data\tcum. logical bytes\tcum. unique bytes\tcum. dedup ratio\tcum. new data\t")
+	for _, r := range results {
+		s, c := r.Stats, r.Cumulative
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%.3f\t%.2f%%\t%v\t%v\t%.3f\t%.2f%%\t\n",
+			r.Trace, s.Chunks, s.UniqueChunks, s.LogicalBytes, s.UniqueBytes, s.DedupRatio, 100*s.NewData,
+			c.LogicalBytes, c.UniqueBytes, c.DedupRatio, 100*c.NewData)
+	}
+	return tw.Flush()
+}
+
+func writeJSON(w io.Writer, results []*TraceResult) error {
+	encoded, err := json.MarshalIndent(results, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(encoded, '\n'))
+	return err
+}
+
+func main() {
+	defer log.Flush()
+	var descr string = `   This program deduplicates an ordered series of fs-c traces with a full chunk index, i.e. a chunk is
+   stored only the first time it occurs in the series. For each trace and for all traces up to it, it
+   prints the logical bytes, the unique bytes, the deduplication ratio (logical / unique bytes) and the
+   fraction of new data (unique / logical bytes). The series is either given with -traces or taken
+   from the plan.txt written by the generator, ordered by day. The exit status is 1 if a trace
+   couldn't be read completely.
+`
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\nUsage of %s:\n", descr, os.Args[0])
+		flag.PrintDefaults()
+	}
+	in_files := flag.String("traces", "", "The COMMA-SEPERATED and ordered list of trace files.")
+	planFile := flag.String("plan", "", "The plan.txt of the generator. Used instead of -traces.")
+	outFile := flag.String("out", "", "The output file. Default is stdout.")
+	asJSON := flag.Bool("json", false, "Writes the results as JSON instead of a table.")
+	workers := flag.Int("workers", runtime.NumCPU(), "The number of traces or trace parts parsed concurrently.")
+	ranges := flag.Int("ranges", 1, "Splits each uncompressed trace into this many parts that are parsed concurrently. Only traces indexed by fsc_index are split.")
+	debug := flag.Bool("debug", false, "Enables full debug output.")
+	flag.Parse()
+
+	setupLogger(*debug)
+
+	traces := make([]string, 0)
+	if *planFile != "" {
+		var err error
+		if traces, err = readPlan(*planFile); err != nil {
+			log.Critical("Couldn't read plan: ", err)
+			log.Flush()
+			os.Exit(1)
+		}
+	} else {
+		for _, t := range strings.Split(*in_files, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				traces = append(traces, t)
+			}
+		}
+	}
+	if len(traces) == 0 {
+		log.Critical("No trace given.")
+		log.Flush()
+		os.Exit(1)
+	}
+
+	results, complete := computeDedup(traces, *workers, *ranges)
+
+	var out io.Writer = os.Stdout
+	if *outFile != "" {
+		f, err := os.OpenFile(*outFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			log.Critical("Couldn't open output file: ", err)
+			log.Flush()
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	var err error
+	if *asJSON {
+		err = writeJSON(out, results)
+	} else {
+		err = writeText(out, results)
+	}
+	if err != nil {
+		log.Critical("Couldn't write the results: ", err)
+		log.Flush()
+		os.Exit(1)
+	}
+
+	if !complete {
+		log.Flush()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import "testing"
+import "bytes"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/parser"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// returns 20 byte fingerprints starting with the given bytes
+func fingerprints(ids ...byte) [][]byte {
+	fps := make([][]byte, len(ids))
+	for i, id := range ids {
+		fps[i] = append([]byte{id}, make([]byte, 19)...)
+	}
+	return fps
+}
+
+// writes a trace with a file per fingerprint list to a temporary directory and
+// returns its path. The chunks have 100 bytes.
+func writeDedupTrace(t *testing.T, files ...[][]byte) string {
+	entries := make([]*parser.FileEntry, len(files))
+	for i, fps := range files {
+		e := &parser.FileEntry{File: &traceProto.File{Filename: proto.String(fmt.Sprintf("file %v", i)), Fsize: proto.Uint64(uint64(100 * len(fps)))}}
+		for _, fp := range fps {
+			e.Chunks = append(e.Chunks, &traceProto.Chunk{Fp: fp, Csize: proto.Uint32(100)})
+		}
+		entries[i] = e
+	}
+	path := filepath.Join(t.TempDir(), "dedupTesting")
+	w, err := parser.CreateTraceWriter(path)
+	if err != nil {
+		t.Fatalf("Couldn't create test trace: %v", err)
+	}
+	for _, e := range entries {
+		if err := w.WriteEntry(e); err != nil {
+			t.Fatalf("Couldn't write test trace: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Couldn't write test trace: %v", err)
+	}
+	return path
+}
+
+func TestComputeDedup(t *testing.T) {
+	trace0 := writeDedupTrace(t, fingerprints(1, 2), fingerprints(2, 3))
+	trace1 := writeDedupTrace(t, fingerprints(1, 2, 3, 4))
+
+	results, complete := computeDedup([]string{trace0, trace1}, 2, 1)
+	if !complete || len(results) != 2 {
+		t.Fatalf("Couldn't deduplicate traces: %+v", results)
+	}
+
+	first, second := results[0], results[1]
+	if first.Stats.Chunks != 4 || first.Stats.UniqueChunks != 3 || first.Stats.LogicalBytes != 400 || first.Stats.UniqueBytes != 300 {
+		t.Fatalf("Wrong stats of the first trace: %+v", first.Stats)
+	} else if first.Cumulative != first.Stats {
+		t.Fatalf("Cumulative stats of the first trace differ: %+v vs. %+v", first.Cumulative, first.Stats)
+	}
+	if second.Stats.UniqueChunks != 1 || second.Stats.UniqueBytes != 100 || second.Stats.DedupRatio != 4 || second.Stats.NewData != 0.25 {
+		t.Fatalf("Wrong stats of the second trace: %+v", second.Stats)
+	} else if c := second.Cumulative; c.Chunks != 8 || c.UniqueChunks != 4 || c.LogicalBytes != 800 || c.UniqueBytes != 400 || c.DedupRatio != 2 || c.NewData != 0.5 {
+		t.Fatalf("Wrong cumulative stats: %+v", c)
+	}
+
+	// the order of the series matters
+	results, _ = computeDedup([]string{trace1, trace0}, 2, 1)
+	if results[0].Stats.UniqueChunks != 4 || results[1].Stats.UniqueChunks != 0 || results[1].Cumulative.UniqueBytes != 400 {
+		t.Fatalf("Wrong stats of the reversed series: %+v, %+v", results[0], results[1])
+	}
+
+	results, complete = computeDedup([]string{trace0, "doesNotExist"}, 2, 1)
+	if complete || results[1].Error == "" || results[1].Cumulative.UniqueBytes != 300 {
+		t.Fatalf("Missing trace wasn't reported: %+v", results[1])
+	}
+
+	var text bytes.Buffer
+	if err := writeText(&text, results); err != nil {
+		t.Fatalf("Couldn't write table: %v", err)
+	} else if lines := strings.Split(strings.TrimSpace(text.String()), "\n"); len(lines) != 3 || !strings.Contains(lines[1], "1.333") {
+		t.Fatalf("Wrong table:\n%v", text.String())
+	}
+}
+
+func TestComputeDedupShortFingerprints(t *testing.T) {
+	// fingerprints shorter than the 12 bytes of the chunk index; {1} must
+	// neither collide with {1, 2, 3} nor with {1, 0, 3}
+	files := [][][]byte{{{1, 2, 3}, {1}}, {{1, 0, 3}, {1}, {1, 2, 3}}}
+	trace := writeDedupTrace(t, files...)
+
+	results, complete := computeDedup([]string{trace}, 1, 1)
+	if !complete {
+		t.Fatalf("Couldn't deduplicate trace: %+v", results[0])
+	} else if s := results[0].Stats; s.Chunks != 5 || s.UniqueChunks != 3 || s.UniqueBytes != 300 {
+		t.Fatalf("Wrong stats: %+v", s)
+	}
+}
+
+func TestReadPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsc_dedup")
+	if err != nil {
+		t.Fatalf("Couldn't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// gen_10 exists in the directory of the plan only, as if the output
+	// directory was moved
+	existing := filepath.Join(dir, "gen_2_stream1")
+	ioutil.WriteFile(existing, nil, 0666)
+	ioutil.WriteFile(filepath.Join(dir, "gen_10_stream0"), nil, 0666)
+	plan := fmt.Sprintf(`{"Config": {"Seed": 1}, "Plan": {
+		"10": [{"TargetFile": "/moved/gen_10_stream0", "SourceFiles": ["a"]}],
+		"2": [{"TargetFile": %q}, {"TargetFile": "/moved/gen_2_stream0"}]}}`, existing)
+	ioutil.WriteFile(filepath.Join(dir, "plan.txt"), []byte(plan), 0666)
+
+	traces, err := readPlan(filepath.Join(dir, "plan.txt"))
+	if err != nil {
+		t.Fatalf("Couldn't read plan: %v", err)
+	}
+	expected := []string{existing, filepath.Join(dir, "gen_2_stream0"), filepath.Join(dir, "gen_10_stream0")}
+	if fmt.Sprint(traces) != fmt.Sprint(expected) {
+		t.Fatalf("Wrong traces: got %v, expected: %v", traces, expected)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "plan.txt"), []byte(`{"Plan": {"monday": []}}`), 0666)
+	if _, err := readPlan(filepath.Join(dir, "plan.txt")); err == nil {
+		t.Fatal("Reading a plan with an invalid day succeeded")
+	}
+}
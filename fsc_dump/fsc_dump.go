@@ -0,0 +1,301 @@
+package main
+
+import "fmt"
+import "flag"
+import "os"
+import "io"
+import "bufio"
+import "context"
+import "encoding/hex"
+import "encoding/json"
+import "regexp"
+
+import log "github.com/cihub/seelog"
+import "github.com/jkaiser/dedup_tools/parser"
+
+func setupLogger(debug bool) {
+	var testConfig string
+	if debug {
+		testConfig = `
+<seelog type="sync">
+    <outputs formatid="main">
+        <filter levels="debug">
+            <console/>
+        </filter>
+        <filter levels="info">
+            <console/>
+        </filter>
+        <filter levels="error">
+            <console/>
+        </filter>
+        <filter levels="warn">
+            <console/>
+        </filter>
+        <filter levels="critical">
+            <console/>
+        </filter>
+    </outputs>
+    <formats>
+        <format id="main" format="%Date %Time [%Level] %Msg%n"/>
+    </formats>
+</seelog>`
+
+	} else {
+		testConfig = `
+<seelog type="sync">
+    <outputs formatid="main">
+        <filter levels="info">
+            <console/>
+        </filter>
+        <filter levels="error">
+            <console/>
+        </filter>
+        <filter levels="warn">
+            <console/>
+        </filter>
+        <filter levels="critical">
+            <console/>
+        </filter>
+    </outputs>
+    <formats>
+        <format id="main" format="%Date %Time [%Level] %Msg%n"/>
+    </formats>
+</seelog>`
+	}
+
+	if logger, err := log.LoggerFromConfigAsBytes([]byte(testConfig)); err != nil {
+		fmt.Println(err)
+	} else {
+		if loggerErr := log.ReplaceLogger(logger); loggerErr != nil {
+			fmt.Println(loggerErr)
+		}
+	}
+}
+
+// filter selects the file entries to dump.
+type filter struct {
+	name  *regexp.Regexp // matches the file name, nil matches all names
+	label string         // the label of the files, "" matches all labels
+	first int            // index of the first file entry
+	last  int            // index of the last file entry, -1 for the end of the trace
+}
+
+func (f *filter) match(index int, e *parser.FileEntry) bool {
+	if index < f.first || (f.last >= 0 && index > f.last) {
+		return false
+	} else if f.label != "" && e.File.GetLabel() != f.label {
+		return false
+	}
+	return f.name == nil || f.name.MatchString(e.File.GetFilename())
+}
+
+// DumpChunk is a chunk in the JSON Lines output.
+type DumpChunk struct {
+	Fp   string // hex encoded
+	Size uint32
+	Zero bool `json:",omitempty"`
+}
+
+// DumpFile is a line of the JSON Lines output.
+type DumpFile struct {
+	Index      int // ordinal of the file entry in the trace
+	Filename   string
+	Size       uint64
+	Type       string `json:",omitempty"`
+	Label      string `json:",omitempty"`
+	Partial    bool   `json:",omitempty"`
+	ChunkCount uint32
+	Chunks     []DumpChunk `json:",omitempty"`
+}
+
+// entryWriter writes a file entry and, unless disabled, its chunks.
+type entryWriter func(index int, e *parser.FileEntry) error
+
+func textWriter(w io.Writer, chunks bool) entryWriter {
+	return func(index int, e *parser.FileEntry) error {
+		f := e.File
+		partial := ""
+		if f.GetPartial() {
+			partial = " partial"
+		}
+		if _, err := fmt.Fprintf(w, "file %v: %q size=%v type=%q label=%q chunks=%v%v\n",
+			index, f.GetFilename(), f.GetFsize(), f.GetType(), f.GetLabel(), f.GetChunkCount(), partial); err != nil {
+			return err
+		}
+		if !chunks {
+			return nil
+		}
+		for i, c := range e.Chunks {
+			zero := ""
+			if c.GetZero() {
+				zero = " zero"
+			}
+			if _, err := fmt.Fprintf(w, "  chunk %v: fp=%x size=%v%v\n", i, c.Fp, c.GetCsize(), zero); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func jsonWriter(w io.Writer, chunks bool) entryWriter {
+	enc := json.NewEncoder(w)
+	return func(index int, e *parser.FileEntry) error {
+		f := e.File
+		d := DumpFile{
+			Index:      index,
+			Filename:   f.GetFilename(),
+			Size:       f.GetFsize(),
+			Type:       f.GetType(),
+			Label:      f.GetLabel(),
+			Partial:    f.GetPartial(),
+			ChunkCount: f.GetChunkCount(),
+		}
+		if chunks {
+			d.Chunks = make([]DumpChunk, len(e.Chunks))
+			for i, c := range e.Chunks {
+				d.Chunks[i] = DumpChunk{Fp: hex.EncodeToString(c.Fp), Size: c.GetCsize(), Zero: c.GetZero()}
+			}
+		}
+		return enc.Encode(d)
+	}
+}
+
+// newParser returns a parser for the trace read from f that starts at the
+// first file entry of flt. The index of the trace is used to seek there if
+// it exists. Returns the index of the first file entry of the parser.
+func newParser(trace string, f *os.File, flt filter) (*parser.ProtoParser, int, error) {
+	p, err := parser.NewProtoParserFromReader(trace, f, nil)
+	if err != nil || flt.first == 0 {
+		return p, 0, err
+	}
+	ix, err := parser.LoadIndex(trace + parser.IndexSuffix)
+	if err != nil {
+		return p, 0, nil
+	}
+	if err = p.SeekFile(ix, flt.first); err == nil {
+		return p, flt.first, nil
+	}
+	log.Debug("Couldn't seek to file entry ", flt.first, ", parsing from the start: ", err)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	p, err = parser.NewProtoParserFromReader(trace, f, nil)
+	return p, 0, err
+}
+
+// dump writes the file entries of the trace selected by flt. The parsing
+// stops after the last selected file entry.
+func dump(trace string, flt filter, write entryWriter) error {
+	f, err := os.Open(trace)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p, index, err := newParser(trace, f, flt)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	entries := make(chan *parser.FileEntry, parser.ConstMaxFileEntries)
+	errChan := make(chan error, 1)
+	go func() { errChan <- p.ParseRecordsContext(ctx, entries) }()
+
+	// entries is drained after an error until the parser gives up
+	var writeErr error
+	stopped := false
+	for e := range entries {
+		if writeErr == nil && !stopped {
+			if flt.last >= 0 && index > flt.last {
+				stopped = true
+				cancel()
+			} else if flt.match(index, e) {
+				if writeErr = write(index, e); writeErr != nil {
+					cancel()
+				}
+			}
+		}
+		index++
+	}
+
+	err = <-errChan
+	if writeErr != nil {
+		return writeErr
+	} else if stopped {
+		return nil
+	}
+	return err
+}
+
+func main() {
+	defer log.Flush()
+	var descr string = `   This program prints the file entries and chunks of an fs-c trace, either human-readable or as
+   JSON Lines with a line per file entry. The fingerprints are hex encoded. The file entries can be
+   filtered by a regular expression on the file name, by label and by their index in the trace. If
+   the trace has an index written by fsc_index, it is used to seek to the first file entry.
+`
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\nUsage of %s:\n", descr, os.Args[0])
+		flag.PrintDefaults()
+	}
+	trace := flag.String("trace", "", "The trace file.")
+	outFile := flag.String("out", "", "The output file. Default is stdout.")
+	asJSON := flag.Bool("json", false, "Writes JSON Lines instead of text.")
+	chunks := flag.Bool("chunks", true, "Prints the chunks of the file entries.")
+	name := flag.String("name", "", "Prints only the files whose name matches this regular expression.")
+	label := flag.String("label", "", "Prints only the files with this label.")
+	first := flag.Int("first", 0, "The index of the first file entry to print.")
+	last := flag.Int("last", -1, "The index of the last file entry to print. -1 prints up to the end of the trace.")
+	debug := flag.Bool("debug", false, "Enables full debug output.")
+	flag.Parse()
+
+	setupLogger(*debug)
+
+	if *trace == "" {
+		log.Critical("No trace given.")
+		log.Flush()
+		os.Exit(1)
+	} else if *first < 0 {
+		log.Critical("The first file entry must not be negative.")
+		log.Flush()
+		os.Exit(1)
+	}
+	flt := filter{label: *label, first: *first, last: *last}
+	if *name != "" {
+		var err error
+		if flt.name, err = regexp.Compile(*name); err != nil {
+			log.Critical("Invalid name pattern: ", err)
+			log.Flush()
+			os.Exit(1)
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	if *outFile != "" {
+		f, err := os.OpenFile(*outFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			log.Critical("Couldn't open output file: ", err)
+			log.Flush()
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = bufio.NewWriter(f)
+	}
+
+	write := textWriter(out, *chunks)
+	if *asJSON {
+		write = jsonWriter(out, *chunks)
+	}
+	err := dump(*trace, flt, write)
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		log.Critical("Couldn't dump the trace: ", err)
+		log.Flush()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import "testing"
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "path/filepath"
+import "regexp"
+import "strings"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/parser"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// writes a trace of n files to a temporary directory and returns its path.
+// File i is named "file <i>", has 100*i bytes, the label "even" if i is even
+// and i%3 chunks of 50 bytes with the fingerprint {i, j}, the second of which
+// is a zero chunk. The last file is partial.
+func writeDumpTrace(t *testing.T, n int) string {
+	path := filepath.Join(t.TempDir(), "dumpTesting")
+	w, err := parser.CreateTraceWriter(path)
+	if err != nil {
+		t.Fatalf("Couldn't create test trace: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		f := &traceProto.File{Filename: proto.String(fmt.Sprintf("file %v", i)), Fsize: proto.Uint64(uint64(100 * i))}
+		if i%2 == 0 {
+			f.Label = proto.String("even")
+		}
+		if i == n-1 {
+			f.Partial = proto.Bool(true)
+		}
+		e := &parser.FileEntry{File: f}
+		for j := 0; j < i%3; j++ {
+			e.Chunks = append(e.Chunks, &traceProto.Chunk{Fp: []byte{byte(i), byte(j)}, Csize: proto.Uint32(50), Zero: proto.Bool(j == 1)})
+		}
+		if err := w.WriteEntry(e); err != nil {
+			t.Fatalf("Couldn't write test trace: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Couldn't write test trace: %v", err)
+	}
+	return path
+}
+
+// dumps the trace as JSON Lines and returns the decoded lines
+func dumpJSON(t *testing.T, trace string, flt filter, chunks bool) []DumpFile {
+	var buf bytes.Buffer
+	if err := dump(trace, flt, jsonWriter(&buf, chunks)); err != nil {
+		t.Fatalf("Couldn't dump trace: %v", err)
+	}
+	files := make([]DumpFile, 0)
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var f DumpFile
+		if err := dec.Decode(&f); err != nil {
+			t.Fatalf("Couldn't decode line: %v", err)
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+func TestDumpJSON(t *testing.T) {
+	trace := writeDumpTrace(t, 10)
+
+	files := dumpJSON(t, trace, filter{last: -1}, true)
+	if len(files) != 10 {
+		t.Fatalf("Wrong number of files: %v", len(files))
+	}
+	f := files[5]
+	if f.Index != 5 || f.Filename != "file 5" || f.Size != 500 || f.Label != "" || f.ChunkCount != 2 || len(f.Chunks) != 2 {
+		t.Fatalf("Wrong file: %+v", f)
+	} else if f.Chunks[1] != (DumpChunk{Fp: "0501", Size: 50, Zero: true}) {
+		t.Fatalf("Wrong chunk: %+v", f.Chunks[1])
+	} else if !files[9].Partial || files[8].Partial || files[8].Label != "even" {
+		t.Fatalf("Wrong flags: %+v, %+v", files[8], files[9])
+	}
+
+	if files = dumpJSON(t, trace, filter{last: -1}, false); files[5].ChunkCount != 2 || files[5].Chunks != nil {
+		t.Fatalf("Chunks weren't left out: %+v", files[5])
+	}
+}
+
+func TestDumpFilter(t *testing.T) {
+	trace := writeDumpTrace(t, 20)
+
+	indexes := func(files []DumpFile) string {
+		s := make([]string, len(files))
+		for i, f := range files {
+			s[i] = fmt.Sprint(f.Index)
+		}
+		return strings.Join(s, ",")
+	}
+
+	tests := []struct {
+		flt      filter
+		expected string
+	}{
+		{filter{first: 3, last: 6}, "3,4,5,6"},
+		{filter{first: 18, last: -1}, "18,19"},
+		{filter{first: 25, last: -1}, ""},
+		{filter{label: "even", first: 3, last: 9}, "4,6,8"},
+		{filter{name: regexp.MustCompile(`file 1\d$`), label: "even", last: -1}, "10,12,14,16,18"},
+		{filter{name: regexp.MustCompile(`^dir/`), last: -1}, ""},
+	}
+	check := func() {
+		for _, test := range tests {
+			if got := indexes(dumpJSON(t, trace, test.flt, true)); got != test.expected {
+				t.Fatalf("Wrong files for %+v: got %v, expected: %v", test.flt, got, test.expected)
+			}
+		}
+	}
+	check()
+
+	// the same with seeking by the index
+	if _, err := parser.IndexProtoFile(trace, trace+parser.IndexSuffix, 4); err != nil {
+		t.Fatalf("Couldn't index trace: %v", err)
+	}
+	check()
+}
+
+func TestDumpText(t *testing.T) {
+	trace := writeDumpTrace(t, 3)
+
+	var buf bytes.Buffer
+	if err := dump(trace, filter{first: 2, last: -1}, textWriter(&buf, true)); err != nil {
+		t.Fatalf("Couldn't dump trace: %v", err)
+	}
+	expected := `file 2: "file 2" size=200 type="" label="even" chunks=2 partial
+  chunk 0: fp=0200 size=50
+  chunk 1: fp=0201 size=50 zero
+`
+	if buf.String() != expected {
+		t.Fatalf("Wrong text output:\n%v\nexpected:\n%v", buf.String(), expected)
+	}
+
+	if err := dump("doesNotExist", filter{last: -1}, textWriter(&buf, true)); err == nil {
+		t.Fatal("Dumping a missing trace succeeded")
+	}
+}
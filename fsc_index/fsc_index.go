@@ -0,0 +1,109 @@
+package main
+
+import "fmt"
+import "flag"
+import "os"
+
+import log "github.com/cihub/seelog"
+import "github.com/jkaiser/dedup_tools/parser"
+
+func setupLogger(debug bool) {
+	var testConfig string
+	if debug {
+		testConfig = `
+<seelog type="sync">
+    <outputs formatid="main">
+        <filter levels="debug">
+            <console/>
+        </filter>
+        <filter levels="info">
+            <console/>
+        </filter>
+        <filter levels="error">
+            <console/>
+        </filter>
+        <filter levels="warn">
+            <console/>
+        </filter>
+        <filter levels="critical">
+            <console/>
+        </filter>
+    </outputs>
+    <formats>
+        <format id="main" format="%Date %Time [%Level] %Msg%n"/>
+    </formats>
+</seelog>`
+
+	} else {
+		testConfig = `
+<seelog type="sync">
+    <outputs formatid="main">
+        <filter levels="info">
+            <console/>
+        </filter>
+        <filter levels="error">
+            <console/>
+        </filter>
+        <filter levels="warn">
+            <console/>
+        </filter>
+        <filter levels="critical">
+            <console/>
+        </filter>
+    </outputs>
+    <formats>
+        <format id="main" format="%Date %Time [%Level] %Msg%n"/>
+    </formats>
+</seelog>`
+	}
+
+	if logger, err := log.LoggerFromConfigAsBytes([]byte(testConfig)); err != nil {
+		fmt.Println(err)
+	} else {
+		if loggerErr := log.ReplaceLogger(logger); loggerErr != nil {
+			fmt.Println(loggerErr)
+		}
+	}
+}
+
+func main() {
+	defer log.Flush()
+	var descr string = `   This program indexes an uncompressed fs-c trace. For every file entry (or every n-th one with
+   -interval) the index records the file ordinal, the byte offset of the entry, its chunk count and
+   the sum of the sizes of all preceding files. The parser uses the index to start at a given file
+   entry or byte offset without parsing the trace from the beginning.
+`
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\nUsage of %s:\n", descr, os.Args[0])
+		flag.PrintDefaults()
+	}
+	inFile := flag.String("trace", "", "The trace file to index.")
+	outFile := flag.String("out", "", "The output file for the index. Default is the trace file with the suffix "+parser.IndexSuffix+".")
+	interval := flag.Int("interval", 1, "Index only every n-th file entry.")
+	debug := flag.Bool("debug", false, "Enables full debug output.")
+	flag.Parse()
+
+	setupLogger(*debug)
+
+	if *inFile == "" {
+		log.Critical("-trace is required.")
+		log.Flush()
+		os.Exit(1)
+	} else if *interval < 1 {
+		log.Critical("-interval must be at least 1.")
+		log.Flush()
+		os.Exit(1)
+	}
+	if *outFile == "" {
+		*outFile = *inFile + parser.IndexSuffix
+	}
+
+	files, err := parser.IndexProtoFile(*inFile, *outFile, *interval)
+	if err != nil {
+		log.Critical("Couldn't index ", *inFile, ": ", err)
+		log.Flush()
+		os.Remove(*outFile)
+		os.Exit(1)
+	}
+	log.Info("indexed ", files, " file entries of ", *inFile, " in ", *outFile)
+}
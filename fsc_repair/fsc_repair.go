@@ -0,0 +1,90 @@
+package main
+
+import "fmt"
+import "flag"
+import "os"
+import "encoding/json"
+
+import log "github.com/cihub/seelog"
+import "github.com/jkaiser/dedup_tools/parser"
+
+// setupLogger makes seelog write to stderr, as stdout may carry the report.
+func setupLogger(debug bool) {
+	var level log.LogLevel = log.InfoLvl
+	if debug {
+		level = log.DebugLvl
+	}
+	if logger, err := log.LoggerFromWriterWithMinLevelAndFormat(os.Stderr, level, "%Date %Time [%Level] %Msg%n"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else if loggerErr := log.ReplaceLogger(logger); loggerErr != nil {
+		fmt.Fprintln(os.Stderr, loggerErr)
+	}
+}
+
+func writeSummary(report *parser.RepairReport, summaryFile string) error {
+	encoded, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		return err
+	}
+	encoded = append(encoded, '\n')
+
+	if summaryFile == "" {
+		_, err = os.Stdout.Write(encoded)
+		return err
+	}
+	f, err := os.OpenFile(summaryFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(encoded); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func main() {
+	defer log.Flush()
+	var descr string = `   This program repairs a truncated or corrupted fs-c trace. It keeps all complete file entries and
+   drops undecodable messages and chunks beyond the chunkCount of their file entry. Entries followed
+   by too few chunks, like the final entry of a truncated trace, are marked as partial and their
+   chunkCount is rewritten. A JSON summary of what was dropped is written to stdout or to the
+   summary file.
+`
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\nUsage of %s:\n", descr, os.Args[0])
+		flag.PrintDefaults()
+	}
+	inFile := flag.String("trace", "", "The trace file to repair.")
+	outFile := flag.String("out", "", "The output file for the repaired trace.")
+	summaryFile := flag.String("summary", "", "The output file for the JSON summary. Default is stdout.")
+	dropIncomplete := flag.Bool("dropIncomplete", false, "Drop incomplete file entries instead of marking them as partial.")
+	debug := flag.Bool("debug", false, "Enables full debug output.")
+	flag.Parse()
+
+	setupLogger(*debug)
+
+	if *inFile == "" || *outFile == "" {
+		log.Critical("Both -trace and -out are required.")
+		log.Flush()
+		os.Exit(1)
+	} else if *inFile == *outFile {
+		log.Critical("The repaired trace must not overwrite the input trace.")
+		log.Flush()
+		os.Exit(1)
+	}
+
+	report, err := parser.RepairProtoFile(*inFile, *outFile, parser.RepairOptions{DropIncomplete: *dropIncomplete})
+	if err != nil {
+		log.Critical("Couldn't repair ", *inFile, ": ", err)
+		log.Flush()
+		os.Exit(1)
+	}
+	log.Info("wrote ", report.Files, " file entries with ", report.Chunks, " chunks to ", *outFile)
+
+	if err := writeSummary(report, *summaryFile); err != nil {
+		log.Critical("Couldn't write the summary: ", err)
+		log.Flush()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import "fmt"
+import "flag"
+import "os"
+import "io"
+import "sort"
+import "strings"
+import "runtime"
+import "math/bits"
+import "text/tabwriter"
+import "encoding/json"
+
+import log "github.com/cihub/seelog"
+import "github.com/jkaiser/dedup_tools/parser"
+
+// setupLogger makes seelog write to stderr, as stdout may carry the report.
+func setupLogger(debug bool) {
+	var level log.LogLevel = log.InfoLvl
+	if debug {
+		level = log.DebugLvl
+	}
+	if logger, err := log.LoggerFromWriterWithMinLevelAndFormat(os.Stderr, level, "%Date %Time [%Level] %Msg%n"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else if loggerErr := log.ReplaceLogger(logger); loggerErr != nil {
+		fmt.Fprintln(os.Stderr, loggerErr)
+	}
+}
+
+// The name of the statistics summed up over all traces.
+const totalName = "total"
+
+// SizeBucket counts the chunks with a size in [Min, Max].
+type SizeBucket struct {
+	Min    uint32
+	Max    uint32
+	Chunks uint64
+	Bytes  uint64
+}
+
+// GroupStats counts the files of a type or label.
+type GroupStats struct {
+	Files uint64
+	Bytes uint64 // sum of the file sizes
+}
+
+// TraceStats are the statistics of a trace. They are encoded as JSON.
+type TraceStats struct {
+	Trace              string
+	Files              uint64
+	EmptyFiles         uint64 // files without chunks
+	PartialFiles       uint64
+	LogicalBytes       uint64 // sum of the file sizes
+	Chunks             uint64
+	ChunkBytes         uint64 // sum of the chunk sizes
+	ZeroChunks         uint64 // chunks flagged as zero chunks
+	MinChunkSize       uint32
+	MaxChunkSize       uint32
+	MeanChunkSize      float64
+	ChunkSizes         []SizeBucket   // power of two buckets, empty ones are left out
+	FingerprintLengths map[int]uint64 // chunks by fingerprint length
+	Types              map[string]*GroupStats
+	Labels             map[string]*GroupStats
+	Error              string `json:",omitempty"`
+
+	buckets [33]SizeBucket // bucket i holds the sizes with bit length i
+}
+
+func newTraceStats(trace string) *TraceStats {
+	s := &TraceStats{
+		Trace:              trace,
+		FingerprintLengths: make(map[int]uint64),
+		Types:              make(map[string]*GroupStats),
+		Labels:             make(map[string]*GroupStats),
+	}
+	for i := range s.buckets {
+		if i > 0 {
+			s.buckets[i].Min = 1 << uint(i-1)
+			s.buckets[i].Max = uint32(1<<uint(i) - 1)
+		}
+	}
+	return s
+}
+
+func addGroup(groups map[string]*GroupStats, name string, files, bytes uint64) {
+	g, ok := groups[name]
+	if !ok {
+		g = new(GroupStats)
+		groups[name] = g
+	}
+	g.Files += files
+	g.Bytes += bytes
+}
+
+func (s *TraceStats) addChunkSizes(min, max uint32, chunks uint64) {
+	if chunks == 0 {
+		return
+	}
+	if s.Chunks == 0 || min < s.MinChunkSize {
+		s.MinChunkSize = min
+	}
+	if max > s.MaxChunkSize {
+		s.MaxChunkSize = max
+	}
+}
+
+func (s *TraceStats) add(e *parser.FileEntry) {
+	f := e.File
+	s.Files++
+	s.LogicalBytes += f.GetFsize()
+	if len(e.Chunks) == 0 {
+		s.EmptyFiles++
+	}
+	if f.GetPartial() {
+		s.PartialFiles++
+	}
+	addGroup(s.Types, f.GetType(), 1, f.GetFsize())
+	addGroup(s.Labels, f.GetLabel(), 1, f.GetFsize())
+
+	for _, c := range e.Chunks {
+		size := c.GetCsize()
+		s.addChunkSizes(size, size, 1)
+		s.Chunks++
+		s.ChunkBytes += uint64(size)
+		if c.GetZero() {
+			s.ZeroChunks++
+		}
+		s.FingerprintLengths[len(c.Fp)]++
+
+		b := &s.buckets[bits.Len32(size)]
+		b.Chunks++
+		b.Bytes += uint64(size)
+	}
+}
+
+// merge adds the statistics of that to s.
+func (s *TraceStats) merge(that *TraceStats) {
+	s.addChunkSizes(that.MinChunkSize, that.MaxChunkSize, that.Chunks)
+	s.Files += that.Files
+	s.EmptyFiles += that.EmptyFiles
+	s.PartialFiles += that.PartialFiles
+	s.LogicalBytes += that.LogicalBytes
+	s.Chunks += that.Chunks
+	s.ChunkBytes += that.ChunkBytes
+	s.ZeroChunks += that.ZeroChunks
+	for length, n := range that.FingerprintLengths {
+		s.FingerprintLengths[length] += n
+	}
+	for name, g := range that.Types {
+		addGroup(s.Types, name, g.Files, g.Bytes)
+	}
+	for name, g := range that.Labels {
+		addGroup(s.Labels, name, g.Files, g.Bytes)
+	}
+	for i := range that.buckets {
+		s.buckets[i].Chunks += that.buckets[i].Chunks
+		s.buckets[i].Bytes += that.buckets[i].Bytes
+	}
+}
+
+// finish computes the derived statistics.
+func (s *TraceStats) finish() {
+	if s.Chunks > 0 {
+		s.MeanChunkSize = float64(s.ChunkBytes) / float64(s.Chunks)
+	}
+	s.ChunkSizes = make([]SizeBucket, 0)
+	for _, b := range s.buckets {
+		if b.Chunks > 0 {
+			s.ChunkSizes = append(s.ChunkSizes, b)
+		}
+	}
+}
+
+// computes the statistics of all traces with the given number of concurrent
+// workers. If there is more than one trace, the statistics summed up over all
+// traces are appended. Returns whether all traces were read completely.
+func computeStats(traces []string, workers int) ([]*TraceStats, bool) {
+	stats := make([]*TraceStats, len(traces))
+	for i, trace := range traces {
+		stats[i] = newTraceStats(trace)
+	}
+
+	records := make(chan *parser.Record, parser.ConstMaxFileEntries)
+	errChan := make(chan []error, 1)
+	go func() {
+		errChan <- parser.ParseAll(traces, parser.PipelineOptions{Format: parser.FormatProto, Workers: workers}, records)
+	}()
+	for r := range records {
+		stats[r.Trace].add(r.Entry)
+	}
+
+	complete := true
+	for i, err := range <-errChan {
+		if err != nil {
+			log.Error("Couldn't read the whole trace ", traces[i], ": ", err)
+			stats[i].Error = err.Error()
+			complete = false
+		}
+	}
+
+	for _, s := range stats {
+		s.finish()
+	}
+	if len(stats) > 1 {
+		total := newTraceStats(totalName)
+		for _, s := range stats {
+			total.merge(s)
+		}
+		total.finish()
+		stats = append(stats, total)
+	}
+	return stats, complete
+}
+
+func percent(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// writes the top groups by number of files. top 0 writes all groups.
+func writeGroups(w io.Writer, title string, groups map[string]*GroupStats, files uint64, top int) {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := groups[names[i]], groups[names[j]]
+		if a.Files != b.Files {
+			return a.Files > b.Files
+		}
+		return names[i] < names[j]
+	})
+
+	fmt.Fprintf(w, "%v:\n", title)
+	for i, name := range names {
+		if top > 0 && i == top {
+			fmt.Fprintf(w, "  ... %v more\n", len(names)-top)
+			break
+		}
+		g := groups[name]
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(w, "  %v\t%v files\t%.2f%%\t%v bytes\n", name, g.Files, percent(g.Files, files), g.Bytes)
+	}
+}
+
+// writes the statistics in human-readable form. At most top types and labels
+// are listed per trace.
+func writeText(w io.Writer, stats []*TraceStats, top int) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, s := range stats {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "trace:\t%v\n", s.Trace)
+		if s.Error != "" {
+			fmt.Fprintf(tw, "error:\t%v\n", s.Error)
+		}
+		fmt.Fprintf(tw, "files:\t%v\t(%v empty, %v partial)\n", s.Files, s.EmptyFiles, s.PartialFiles)
+		fmt.Fprintf(tw, "logical bytes:\t%v\n", s.LogicalBytes)
+		fmt.Fprintf(tw, "chunks:\t%v\t(%v zero chunks)\n", s.Chunks, s.ZeroChunks)
+		fmt.Fprintf(tw, "chunk bytes:\t%v\n", s.ChunkBytes)
+		fmt.Fprintf(tw, "chunk size:\tmin %v, mean %.1f, max %v\n", s.MinChunkSize, s.MeanChunkSize, s.MaxChunkSize)
+
+		fmt.Fprintf(tw, "chunk sizes:\n")
+		for _, b := range s.ChunkSizes {
+			fmt.Fprintf(tw, "  %v - %v\t%v chunks\t%.2f%%\t%v bytes\n", b.Min, b.Max, b.Chunks, percent(b.Chunks, s.Chunks), b.Bytes)
+		}
+
+		lengths := make([]int, 0, len(s.FingerprintLengths))
+		for length := range s.FingerprintLengths {
+			lengths = append(lengths, length)
+		}
+		sort.Ints(lengths)
+		fmt.Fprintf(tw, "fingerprint lengths:\n")
+		for _, length := range lengths {
+			n := s.FingerprintLengths[length]
+			fmt.Fprintf(tw, "  %v bytes\t%v chunks\t%.2f%%\n", length, n, percent(n, s.Chunks))
+		}
+
+		writeGroups(tw, "types", s.Types, s.Files, top)
+		writeGroups(tw, "labels", s.Labels, s.Files, top)
+	}
+	return tw.Flush()
+}
+
+func writeJSON(w io.Writer, stats []*TraceStats) error {
+	encoded, err := json.MarshalIndent(stats, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(encoded, '\n'))
+	return err
+}
+
+func main() {
+	defer log.Flush()
+	var descr string = `   This program prints statistics of fs-c traces: the number of files, the logical bytes, the
+   number of chunks, a histogram of the chunk sizes, the distribution of the fingerprint lengths and
+   the files per type and label. With more than one trace the statistics summed up over all traces
+   are printed as well. The exit status is 1 if a trace couldn't be read completely.
+`
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\nUsage of %s:\n", descr, os.Args[0])
+		flag.PrintDefaults()
+	}
+	in_files := flag.String("traces", "", "The COMMA-SEPERATED list of trace files.")
+	outFile := flag.String("out", "", "The output file. Default is stdout.")
+	asJSON := flag.Bool("json", false, "Writes the statistics as JSON instead of text.")
+	top := flag.Int("top", 10, "The number of types and labels listed in the text output. 0 lists all of them.")
+	workers := flag.Int("workers", runtime.NumCPU(), "The number of traces parsed concurrently.")
+	debug := flag.Bool("debug", false, "Enables full debug output.")
+	flag.Parse()
+
+	setupLogger(*debug)
+
+	traces := make([]string, 0)
+	for _, t := range strings.Split(*in_files, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			traces = append(traces, t)
+		}
+	}
+	if len(traces) == 0 {
+		log.Critical("No trace given.")
+		log.Flush()
+		os.Exit(1)
+	}
+
+	stats, complete := computeStats(traces, *workers)
+
+	var out io.Writer = os.Stdout
+	if *outFile != "" {
+		f, err := os.OpenFile(*outFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			log.Critical("Couldn't open output file: ", err)
+			log.Flush()
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	var err error
+	if *asJSON {
+		err = writeJSON(out, stats)
+	} else {
+		err = writeText(out, stats, *top)
+	}
+	if err != nil {
+		log.Critical("Couldn't write the statistics: ", err)
+		log.Flush()
+		os.Exit(1)
+	}
+
+	if !complete {
+		log.Flush()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import "testing"
+import "bytes"
+import "encoding/json"
+import "path/filepath"
+import "strings"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/parser"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// writes a trace with a file without chunks, a partial file and a file with
+// chunks of 3 sizes and 2 fingerprint lengths to a temporary directory and
+// returns its path
+func writeStatTrace(t *testing.T) string {
+	entries := []*parser.FileEntry{
+		{File: &traceProto.File{Filename: proto.String("empty"), Fsize: proto.Uint64(0), Type: proto.String("txt")}},
+		{File: &traceProto.File{Filename: proto.String("a.txt"), Fsize: proto.Uint64(5000), Type: proto.String("txt"), Label: proto.String("docs")},
+			Chunks: []*traceProto.Chunk{
+				{Fp: make([]byte, 20), Csize: proto.Uint32(4096)},
+				{Fp: make([]byte, 20), Csize: proto.Uint32(904)},
+			}},
+		{File: &traceProto.File{Filename: proto.String("b.bin"), Fsize: proto.Uint64(9000), Type: proto.String("bin"), Label: proto.String("docs"), Partial: proto.Bool(true)},
+			Chunks: []*traceProto.Chunk{
+				{Fp: make([]byte, 12), Csize: proto.Uint32(8192), Zero: proto.Bool(true)},
+			}},
+	}
+	path := filepath.Join(t.TempDir(), "statTesting")
+	w, err := parser.CreateTraceWriter(path)
+	if err != nil {
+		t.Fatalf("Couldn't create test trace: %v", err)
+	}
+	for _, e := range entries {
+		if err := w.WriteEntry(e); err != nil {
+			t.Fatalf("Couldn't write test trace: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Couldn't write test trace: %v", err)
+	}
+	return path
+}
+
+func TestComputeStats(t *testing.T) {
+	trace := writeStatTrace(t)
+
+	stats, complete := computeStats([]string{trace}, 1)
+	if !complete || len(stats) != 1 {
+		t.Fatalf("Couldn't compute stats: %+v", stats)
+	}
+	s := stats[0]
+	if s.Files != 3 || s.EmptyFiles != 1 || s.PartialFiles != 1 || s.LogicalBytes != 14000 {
+		t.Fatalf("Wrong file counts: %+v", s)
+	} else if s.Chunks != 3 || s.ChunkBytes != 13192 || s.ZeroChunks != 1 {
+		t.Fatalf("Wrong chunk counts: %+v", s)
+	} else if s.MinChunkSize != 904 || s.MaxChunkSize != 8192 {
+		t.Fatalf("Wrong chunk size range: %v - %v", s.MinChunkSize, s.MaxChunkSize)
+	}
+
+	// 904 is in [512, 1023], 4096 in [4096, 8191] and 8192 in [8192, 16383]
+	if len(s.ChunkSizes) != 3 {
+		t.Fatalf("Wrong chunk size histogram: %+v", s.ChunkSizes)
+	}
+	for i, min := range []uint32{512, 4096, 8192} {
+		if b := s.ChunkSizes[i]; b.Min != min || b.Max != 2*min-1 || b.Chunks != 1 {
+			t.Fatalf("Wrong chunk size bucket %v: %+v", i, b)
+		}
+	}
+	if len(s.FingerprintLengths) != 2 || s.FingerprintLengths[20] != 2 || s.FingerprintLengths[12] != 1 {
+		t.Fatalf("Wrong fingerprint lengths: %v", s.FingerprintLengths)
+	}
+	if len(s.Types) != 2 || s.Types["txt"].Files != 2 || s.Types["bin"].Bytes != 9000 {
+		t.Fatalf("Wrong types: %+v", s.Types)
+	} else if len(s.Labels) != 2 || s.Labels["docs"].Files != 2 || s.Labels[""].Files != 1 {
+		t.Fatalf("Wrong labels: %+v", s.Labels)
+	}
+}
+
+func TestComputeStatsTotal(t *testing.T) {
+	trace := writeStatTrace(t)
+
+	stats, complete := computeStats([]string{trace, trace, "doesNotExist"}, 2)
+	if complete {
+		t.Fatal("Missing trace wasn't reported")
+	} else if len(stats) != 4 || stats[2].Error == "" || stats[3].Trace != totalName {
+		t.Fatalf("Wrong stats: %+v", stats)
+	}
+	total := stats[3]
+	if total.Files != 6 || total.Chunks != 6 || total.MinChunkSize != 904 || total.ChunkSizes[0].Chunks != 2 {
+		t.Fatalf("Wrong total: %+v", total)
+	} else if total.Types["txt"].Files != 4 || total.FingerprintLengths[12] != 2 {
+		t.Fatalf("Wrong total groups: %+v", total)
+	}
+}
+
+func TestWriteStats(t *testing.T) {
+	trace := writeStatTrace(t)
+	stats, _ := computeStats([]string{trace}, 1)
+
+	var text bytes.Buffer
+	if err := writeText(&text, stats, 1); err != nil {
+		t.Fatalf("Couldn't write text: %v", err)
+	}
+	for _, s := range []string{"statTesting", "904", "txt", "... 1 more"} {
+		if !strings.Contains(text.String(), s) {
+			t.Fatalf("Text output is missing %q:\n%v", s, text.String())
+		}
+	}
+
+	var encoded bytes.Buffer
+	if err := writeJSON(&encoded, stats); err != nil {
+		t.Fatalf("Couldn't write JSON: %v", err)
+	}
+	var decoded []*TraceStats
+	if err := json.Unmarshal(encoded.Bytes(), &decoded); err != nil {
+		t.Fatalf("Couldn't decode JSON: %v", err)
+	} else if len(decoded) != 1 || decoded[0].Chunks != 3 || decoded[0].Labels["docs"].Files != 2 || len(decoded[0].ChunkSizes) != 3 {
+		t.Fatalf("Wrong JSON: %v", encoded.String())
+	}
+}
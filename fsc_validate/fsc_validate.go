@@ -0,0 +1,110 @@
+package main
+
+import "fmt"
+import "flag"
+import "os"
+import "strings"
+import "encoding/json"
+
+import log "github.com/cihub/seelog"
+import "github.com/jkaiser/dedup_tools/parser"
+
+// setupLogger makes seelog write to stderr, as stdout may carry the report.
+func setupLogger(debug bool) {
+	var level log.LogLevel = log.InfoLvl
+	if debug {
+		level = log.DebugLvl
+	}
+	if logger, err := log.LoggerFromWriterWithMinLevelAndFormat(os.Stderr, level, "%Date %Time [%Level] %Msg%n"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	} else if loggerErr := log.ReplaceLogger(logger); loggerErr != nil {
+		fmt.Fprintln(os.Stderr, loggerErr)
+	}
+}
+
+// validates all traces. Returns the reports and whether all traces are valid.
+func validateTraces(traces []string, options parser.ValidationOptions) ([]*parser.ValidationReport, bool) {
+	reports := make([]*parser.ValidationReport, 0, len(traces))
+	allValid := true
+	for _, trace := range traces {
+		log.Info("validating ", trace)
+		report, err := parser.ValidateProtoFile(trace, options)
+		if err != nil {
+			log.Error("Couldn't read trace ", trace, ": ", err)
+			report = &parser.ValidationReport{Trace: trace, Issues: []parser.ValidationIssue{{Kind: "unreadable", File: -1, Message: err.Error()}}}
+		}
+
+		if !report.Valid {
+			allValid = false
+			log.Warn(trace, ": ", report.IssueCounts)
+		}
+		reports = append(reports, report)
+	}
+	return reports, allValid
+}
+
+func writeReports(reports []*parser.ValidationReport, resultsFile string) error {
+	encoded, err := json.MarshalIndent(reports, "", "    ")
+	if err != nil {
+		return err
+	}
+	encoded = append(encoded, '\n')
+
+	if resultsFile == "" {
+		_, err = os.Stdout.Write(encoded)
+		return err
+	}
+	f, err := os.OpenFile(resultsFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(encoded); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func main() {
+	var descr string = `   This program checks fs-c traces for consistency and writes a JSON report per trace. It reports
+   file entries whose chunkCount doesn't match the chunks that follow, chunk sizes that don't sum up
+   to the file size, fingerprints of differing length, truncated traces and undecodable messages.
+   The exit status is 1 if any trace is invalid.
+`
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\nUsage of %s:\n", descr, os.Args[0])
+		flag.PrintDefaults()
+	}
+	in_files := flag.String("traces", "", "The COMMA-SEPERATED list of trace files to validate.")
+	resultsFile := flag.String("out", "", "The output file for the JSON reports. Default is stdout.")
+	maxIssues := flag.Int("maxIssues", parser.DefaultMaxIssues, "The maximum number of issues listed per trace. All issues are counted.")
+	skipSizeCheck := flag.Bool("skipSizeCheck", false, "Don't compare the chunk sizes with the file size, e.g. for traces converted from UBC traces.")
+	debug := flag.Bool("debug", false, "Enables full debug output.")
+	flag.Parse()
+
+	setupLogger(*debug)
+
+	traces := make([]string, 0)
+	for _, t := range strings.Split(*in_files, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			traces = append(traces, t)
+		}
+	}
+	if len(traces) == 0 {
+		log.Critical("No trace given.")
+		log.Flush()
+		os.Exit(2)
+	}
+
+	reports, allValid := validateTraces(traces, parser.ValidationOptions{MaxIssues: *maxIssues, SkipSizeCheck: *skipSizeCheck})
+	if err := writeReports(reports, *resultsFile); err != nil {
+		log.Critical("Couldn't write the reports: ", err)
+		log.Flush()
+		os.Exit(2)
+	}
+
+	log.Flush()
+	if !allValid {
+		os.Exit(1)
+	}
+}
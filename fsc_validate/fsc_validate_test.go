@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+import "path/filepath"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/parser"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+func TestValidateTraces(t *testing.T) {
+	// a file of 42 bytes whose 4 chunks sum up to 6 bytes only
+	trace := filepath.Join(t.TempDir(), "validateTesting")
+	e := &parser.FileEntry{File: &traceProto.File{Filename: proto.String("filename A"), Fsize: proto.Uint64(42)}}
+	for i := 0; i < 4; i++ {
+		e.Chunks = append(e.Chunks, &traceProto.Chunk{Fp: []byte{byte(i), 0, 0, 0, 0, 0, 0, 0, 0, 0}, Csize: proto.Uint32(uint32(i))})
+	}
+	w, err := parser.CreateTraceWriter(trace)
+	if err != nil {
+		t.Fatalf("Couldn't create test trace: %v", err)
+	} else if err := w.WriteEntry(e); err != nil {
+		t.Fatalf("Couldn't write test trace: %v", err)
+	} else if err := w.Close(); err != nil {
+		t.Fatalf("Couldn't write test trace: %v", err)
+	}
+
+	reports, allValid := validateTraces([]string{trace}, parser.ValidationOptions{SkipSizeCheck: true})
+	if !allValid || len(reports) != 1 {
+		t.Fatalf("Valid trace was reported as invalid: %+v", reports[0])
+	} else if reports[0].Files != 1 || reports[0].Chunks != 4 {
+		t.Fatalf("Report has wrong counts: %+v", reports[0])
+	}
+
+	reports, allValid = validateTraces([]string{trace, "doesNotExist"}, parser.ValidationOptions{})
+	if allValid {
+		t.Fatal("Invalid traces were reported as valid")
+	} else if len(reports) != 2 || reports[1].Trace != "doesNotExist" {
+		t.Fatalf("Wrong reports: %+v", reports)
+	} else if reports[0].IssueCounts[parser.IssueSizeMismatch] != 1 {
+		t.Fatalf("Size mismatch wasn't reported: %+v", reports[0])
+	}
+}
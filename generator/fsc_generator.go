@@ -15,6 +15,7 @@ import "math/rand"
 import "runtime/pprof"
 
 import log "github.com/cihub/seelog"
+import "github.com/jkaiser/dedup_tools/parser"
 
 // The output scheme for the output json file.
 type OutputJSON struct {
@@ -269,6 +270,13 @@ func main() {
 	numNodes := flag.Int("n", 1, "The number of randomly chosen nodes.")
 	numStreams := flag.Int("s", 0, "The maximum number of streams per week. The nodes will stay in one trace, so there might be weeks that have less traces than available. [default: numNodes]")
 	seed := flag.Int64("seed", 0, "The seed for the internal PRNG.")
+	format := flag.String("format", parser.FormatUBC, fmt.Sprintf("The format of the input traces. One of %v or %q to detect it per trace.", parser.Formats(), parser.FormatAuto))
+	ubcMetadata := flag.Bool("ubcMetadata", false, "Writes the UBC file metadata (timestamps, attributes, fragmentation) of each trace to a JSON lines sidecar <trace>"+ubcMetadataSuffix+". Requires UBC input traces.")
+	ubcHeaders := flag.Bool("ubcHeaders", false, "Writes the headers of the UBC source traces of each trace to a JSON sidecar <trace>"+ubcHeaderSuffix+". Requires UBC input traces.")
+	zeroChunks := flag.String("zeroChunks", parser.ZeroChunkLegacy, fmt.Sprintf("How the zero chunks of UBC traces are represented. One of %v.", parser.ZeroChunkPolicies()))
+	legacyMaxChunkSize := flag.Uint("legacyMaxChunkSize", parser.DefaultLegacyMaxChunkSize, "The maximum chunk size of legacy traces. Larger chunks are skipped. 0 disables the limit.")
+	index := flag.Bool("index", false, "Writes an index of each trace to <trace>"+parser.IndexSuffix+", see fsc_index.")
+	ubcPathNames := flag.Bool("ubcPathNames", false, "Names the file entries of UBC traces \"dirhash/filehash.exthash\" instead of concatenating the hashes.")
 
 	debug := flag.Bool("debug", false, "Enables full debug output.")
 	sim := flag.Bool("sim", false, "Just create buildplan.")
@@ -303,6 +311,22 @@ func main() {
 		log.Error("Trace source directory doesn't exist")
 		return
 	}
+	knownFormat := *format == parser.FormatAuto
+	for _, f := range parser.Formats() {
+		knownFormat = knownFormat || f == *format
+	}
+	if !knownFormat {
+		log.Error("Unknown input format ", *format, ". Known formats: ", parser.Formats())
+		return
+	}
+	knownPolicy := false
+	for _, p := range parser.ZeroChunkPolicies() {
+		knownPolicy = knownPolicy || p == *zeroChunks
+	}
+	if !knownPolicy {
+		log.Error("Unknown zero chunk policy ", *zeroChunks, ". Known policies: ", parser.ZeroChunkPolicies())
+		return
+	}
 
 	// start
 	traces := loadMetadata(*metainfoFile, *traceRun)
@@ -340,6 +364,20 @@ func main() {
 	}
 
 	if !*sim {
-		buildTraces(plan, *maxParallelConversions)
+		opts := conversionOptions{
+			format:       *format,
+			ubcMetadata:  *ubcMetadata,
+			ubcPathNames: *ubcPathNames,
+			ubcHeaders:   *ubcHeaders,
+			zeroChunks:   *zeroChunks,
+			index:        *index,
+			metadata:     make(map[string]*MSTraceFile, len(traces)),
+
+			legacyMaxChunkSize: uint32(*legacyMaxChunkSize),
+		}
+		for _, t := range traces {
+			opts.metadata[path.Join(*data_dir, t.TraceFile)] = t
+		}
+		buildTraces(plan, opts, *maxParallelConversions)
 	}
 }
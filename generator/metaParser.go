@@ -3,7 +3,10 @@ package main
 import "time"
 import "io/ioutil"
 import "encoding/json"
+import "fmt"
+import "strings"
 import log "github.com/cihub/seelog"
+import "github.com/jkaiser/dedup_tools/parser"
 
 /*
 {"CurrentTime": 1253343782,
@@ -32,11 +35,14 @@ import log "github.com/cihub/seelog"
 */
 
 type MSTraceFile struct {
-	CurrentTime int64
-	Hostname    string
-	Username    string
-	TraceFile   string
-	TraceRun    string
+	CurrentTime     int64
+	Hostname        string
+	Username        string
+	TraceFile       string
+	TraceRun        string
+	StreamType      string
+	SystemDirectory string
+	OS              string
 
 	time      time.Time
 	diffToMin time.Duration
@@ -85,3 +91,33 @@ func addRelativeTime(traces []*MSTraceFile) {
 		traces[i].diffToMin = traces[i].time.Sub(min)
 	}
 }
+
+// unescapeHeaderValue returns a value of a UBC header as it appears in the
+// decoded metadata file. The header escapes backslashes, e.g. the system
+// directory is C:\\Windows\\system32 in the header and C:\Windows\system32
+// in the metadata.
+func unescapeHeaderValue(value string) string {
+	return strings.Replace(value, `\\`, `\`, -1)
+}
+
+// compares the header of a UBC trace with its entry in the metadata file.
+// Returns a description of every differing field.
+func checkHeader(h *parser.UBCHeader, m *MSTraceFile) []string {
+	mismatches := make([]string, 0)
+	for _, f := range []struct {
+		name             string
+		header, metadata interface{}
+	}{
+		{"CurrentTime", h.CurrentTime, m.CurrentTime},
+		{"Hostname", unescapeHeaderValue(h.Hostname), m.Hostname},
+		{"Username", unescapeHeaderValue(h.Username), m.Username},
+		{"StreamType", unescapeHeaderValue(h.StreamType), m.StreamType},
+		{"SystemDirectory", unescapeHeaderValue(h.SystemDirectory), m.SystemDirectory},
+		{"OS", unescapeHeaderValue(h.OS), m.OS},
+	} {
+		if f.header != f.metadata {
+			mismatches = append(mismatches, fmt.Sprintf("%v: %v in trace, %v in metadata", f.name, f.header, f.metadata))
+		}
+	}
+	return mismatches
+}
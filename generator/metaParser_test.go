@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+
+import "github.com/jkaiser/dedup_tools/parser"
+
+// the metadata of the ubcTesting trace of the parser package as written in the
+// metadata file
+const ubcTestingMetadata = `[{"CurrentTime": 1252126932, "Hostname": "00000000005c", "Username": "00000000005c",
+	"SystemDirectory": "C:\\Windows\\system32", "StreamType": "Backup Stream", "traceFile": "ubcTesting", "traceRun": "test",
+	"OS": "Microsoft Windows Vista Enterprise Edition, 32-bit Service Pack 2 (build 6002)"}]`
+
+func TestCheckHeader(t *testing.T) {
+	f, err := os.Open("../parser/ubcTesting")
+	if err != nil {
+		t.Fatalf("Couldn't open test trace: %v", err)
+	}
+	defer f.Close()
+	p, err := parser.NewUBCParserFromReader("ubcTesting", f, nil)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
+	}
+	header, err := p.Header()
+	if err != nil {
+		t.Fatalf("Couldn't read header: %v", err)
+	}
+
+	metadataFile := filepath.Join(t.TempDir(), "metadata.json")
+	if err := ioutil.WriteFile(metadataFile, []byte(ubcTestingMetadata), 0644); err != nil {
+		t.Fatalf("Couldn't write metadata: %v", err)
+	}
+	metadata := loadMetadata(metadataFile, "test")
+	if len(metadata) != 1 {
+		t.Fatalf("Couldn't load metadata: %v", metadata)
+	}
+
+	if mismatches := checkHeader(header, metadata[0]); len(mismatches) != 0 {
+		t.Fatalf("Matching header was reported as different: %v", mismatches)
+	}
+	metadata[0].SystemDirectory = `C:\Windows`
+	if mismatches := checkHeader(header, metadata[0]); len(mismatches) != 1 {
+		t.Fatalf("Wrong mismatches: %v", mismatches)
+	}
+}
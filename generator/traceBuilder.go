@@ -1,110 +1,197 @@
 package main
 
-import "bufio"
-import "io"
 import "os"
-import "os/exec"
-import "path"
+import "fmt"
 import "io/ioutil"
+import "encoding/json"
 import log "github.com/cihub/seelog"
-import "github.com/gogo/protobuf/proto"
 import "github.com/jkaiser/dedup_tools/parser"
 
-func writeFull(w io.Writer, d []byte) error {
-	var tw int = len(d)
-	var written int
-
-	for written < tw {
-		if n, err := w.Write(d); err != nil {
-			return err
-		} else {
-			written += n
-			d = d[n:]
+// Writes all messages of toWrite to the trace writer. Drains toWrite even
+// after an error so that the producing parser isn't blocked. Sends the first
+// error (or nil) on errChan when toWrite is closed.
+func WriteMessages(toWrite <-chan []byte, w *parser.TraceWriter, errChan chan<- error) {
+	var err error
+	for m := range toWrite {
+		if err == nil {
+			err = w.WriteMessage(m)
 		}
 	}
+	errChan <- err
+}
+
+// The suffix of the UBC metadata sidecar written next to each target trace.
+const ubcMetadataSuffix = ".ubcmeta.jsonl"
+
+// The options of the conversion of the source traces.
+type conversionOptions struct {
+	format       string // the format of the source traces
+	ubcMetadata  bool   // write the UBC metadata sidecar
+	ubcPathNames bool   // use path-like names for UBC file entries
+	ubcHeaders   bool   // write the UBC header sidecar
+	zeroChunks   string // the zero chunk policy for UBC traces
+	index        bool   // write an index of each target trace
 
-	return nil
+	legacyMaxChunkSize uint32 // the chunk size limit for legacy traces
+
+	metadata map[string]*MSTraceFile // entries of the metadata file by source path
 }
 
-func WriteMessage(toWrite <-chan []byte, path string, closeSignal chan<- bool) {
+// The suffix of the UBC header sidecar written next to each target trace.
+const ubcHeaderSuffix = ".ubcheader.json"
+
+// SourceHeader records the header of a UBC source trace in the header sidecar.
+type SourceHeader struct {
+	Source    string
+	FirstFile int // number of the first file entry of the source in the target trace
+	Header    *parser.UBCHeader
+}
 
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_TRUNC, 0666)
+// parses source and appends its file entries to the trace writer. The UBC
+// metadata of the entries goes to metaWriter unless it is nil. Returns the
+// header of UBC sources.
+func convertSource(source string, opts conversionOptions, traceWriter *parser.TraceWriter, metaWriter *parser.UBCMetadataWriter) (*parser.UBCHeader, error) {
+	pbufChan := make(chan []byte, 10000)
+	traceParser, err := parser.Open(opts.format, source, pbufChan)
 	if err != nil {
-		log.Error("couldn't open output file: ", err)
-		closeSignal <- false
-		return
+		return nil, fmt.Errorf("couldn't create parser for %v: %v", source, err)
 	}
+	// closes the source if the parsing doesn't start
+	defer traceParser.Close()
+
+	var header *parser.UBCHeader
+	if ubcParser, ok := traceParser.(*parser.UBCParser); ok {
+		if header, err = ubcParser.Header(); err != nil {
+			close(pbufChan)
+			return nil, fmt.Errorf("couldn't parse %v: %v", source, err)
+		}
+		if m, ok := opts.metadata[source]; ok {
+			for _, mismatch := range checkHeader(header, m) {
+				log.Warn(source, ": header differs from metadata file: ", mismatch)
+			}
+		}
 
-	bufWriter := bufio.NewWriterSize(f, 4*1024*1024)
-
-	defer f.Close()
-
-	for m := range toWrite {
-		varintBuf := proto.EncodeVarint(uint64(len(m)))
-		if err = writeFull(bufWriter, varintBuf); err != nil {
-			panic(err)
+		ubcParser.SetPathNames(opts.ubcPathNames)
+		if err := ubcParser.SetZeroChunkPolicy(opts.zeroChunks); err != nil {
+			close(pbufChan)
+			return nil, err
 		}
-		if err = writeFull(bufWriter, m); err != nil {
-			panic(err)
+		defer func() {
+			stats := ubcParser.ZeroChunkStats()
+			log.Info(source, ": ", stats.Chunks, " zero chunks with ", stats.Bytes, " bytes in ", stats.Files, " files")
+		}()
+		if metaWriter != nil {
+			ubcParser.SetMetadataHandler(metaWriter.Write)
 		}
+	} else if metaWriter != nil || opts.ubcHeaders {
+		close(pbufChan)
+		return nil, fmt.Errorf("%v isn't a UBC trace, but UBC metadata was requested", source)
 	}
 
-	bufWriter.Flush()
-	closeSignal <- true
+	if legacyParser, ok := traceParser.(*parser.LegacyParser); ok {
+		legacyParser.SetMaxChunkSize(opts.legacyMaxChunkSize)
+		defer func() {
+			for _, err := range legacyParser.FileErrors() {
+				log.Warn(err)
+			}
+		}()
+	}
+
+	writeErrChan := make(chan error)
+	go WriteMessages(pbufChan, traceWriter, writeErrChan)
+	parseErr := traceParser.ParseFile()
+	writeErr := <-writeErrChan
+
+	if parseErr != nil {
+		return nil, fmt.Errorf("couldn't parse %v: %v", source, parseErr)
+	} else if writeErr != nil {
+		return nil, fmt.Errorf("couldn't write: %v", writeErr)
+	}
+	return header, nil
+}
+
+// writes the headers of the sources of a trace as JSON array.
+func writeHeaders(headers []SourceHeader, filepath string) error {
+	encoded, err := json.MarshalIndent(headers, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath, encoded, 0644)
 }
 
-func createSingleTrace(dp PlanForDay, doneChan chan bool) {
+func createSingleTrace(dp PlanForDay, opts conversionOptions, doneChan chan bool) {
 
 	if _, err := os.Stat(dp.TargetFile); err == nil {
 		os.Remove(dp.TargetFile)
 	}
 
-	var tempDir string
-	var err error
-	if tempDir, err = ioutil.TempDir(os.TempDir(), "multiTraceGeneration"); err != nil {
-		log.Error("Couldn't create temporary directory:", err)
+	traceWriter, err := parser.CreateTraceWriter(dp.TargetFile)
+	if err != nil {
+		log.Error("Couldn't open output file ", dp.TargetFile, " :", err)
 		doneChan <- false
 		return
 	}
-
-	for _, source := range dp.SourceFiles {
-
-		// unzip
-		tmpTarget := path.Join(tempDir, path.Base(source))
-		cmd := exec.Command("cp", source, tempDir)
-		if _, err := cmd.Output(); err != nil {
-			log.Error("Couldn't copy ", source, " to ", tempDir, " :", err)
+	var metaWriter *parser.UBCMetadataWriter
+	if opts.ubcMetadata {
+		if metaWriter, err = parser.CreateUBCMetadataWriter(dp.TargetFile + ubcMetadataSuffix); err != nil {
+			log.Error("Couldn't open metadata file for ", dp.TargetFile, " :", err)
+			traceWriter.Close()
 			doneChan <- false
 			return
 		}
+	}
 
-		cmd = exec.Command("gzip", "-f", "-d", tmpTarget)
-		if _, err := cmd.Output(); err != nil {
-			log.Error("Couldn't unzip ", tmpTarget, " :", err)
+	var indexWriter *parser.IndexWriter
+	if opts.index {
+		if indexWriter, err = parser.CreateIndexWriter(dp.TargetFile + parser.IndexSuffix); err != nil {
+			log.Error("Couldn't open index file for ", dp.TargetFile, " :", err)
+			traceWriter.Close()
+			if metaWriter != nil {
+				metaWriter.Close()
+			}
 			doneChan <- false
 			return
 		}
+		traceWriter.SetIndex(indexWriter)
+	}
 
-		tmpTarget = tmpTarget[:len(tmpTarget)-3] // remove the ".gz"
-
-		log.Debug("will parse ", tmpTarget, " to ", dp.TargetFile)
-		pbufChan := make(chan []byte, 10000)
-		closeChan := make(chan bool)
-		go WriteMessage(pbufChan, dp.TargetFile, closeChan)
-		ubcParser := parser.NewUBCParser(tmpTarget, pbufChan)
-		go ubcParser.ParseFile()
-		<-closeChan
-
-		os.Remove(tmpTarget)
+	headers := make([]SourceHeader, 0, len(dp.SourceFiles))
+	for _, source := range dp.SourceFiles {
+		// compressed sources are decompressed on the fly by the parser
+		log.Debug("will parse ", source, " to ", dp.TargetFile)
+		firstFile := traceWriter.Files()
+		var header *parser.UBCHeader
+		if header, err = convertSource(source, opts, traceWriter, metaWriter); err != nil {
+			break
+		}
+		headers = append(headers, SourceHeader{Source: source, FirstFile: firstFile, Header: header})
+	}
+	if err == nil && opts.ubcHeaders {
+		err = writeHeaders(headers, dp.TargetFile+ubcHeaderSuffix)
 	}
 
-	if err = os.RemoveAll(tempDir); err != nil {
-		log.Warn("Couldn't remove temporary directory ", tempDir, " :", err)
+	if metaWriter != nil {
+		if cerr := metaWriter.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if indexWriter != nil {
+		if cerr := indexWriter.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := traceWriter.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Error("Couldn't create ", dp.TargetFile, " :", err)
+		doneChan <- false
+		return
 	}
 	doneChan <- true
 }
 
-func buildTraces(plan *OutputJSON, maxConcurrentTasks int) {
+func buildTraces(plan *OutputJSON, opts conversionOptions, maxConcurrentTasks int) {
 	runningTasks := 0
 	doneChan := make(chan bool, 100)
 
@@ -112,11 +199,11 @@ func buildTraces(plan *OutputJSON, maxConcurrentTasks int) {
 
 		for i := range plansForDay {
 			if runningTasks < maxConcurrentTasks {
-				go createSingleTrace(plansForDay[i], doneChan)
+				go createSingleTrace(plansForDay[i], opts, doneChan)
 				runningTasks++
 			} else {
 				<-doneChan
-				go createSingleTrace(plansForDay[i], doneChan)
+				go createSingleTrace(plansForDay[i], opts, doneChan)
 			}
 		}
 	}
@@ -0,0 +1,44 @@
+package parser
+
+import "bufio"
+import "bytes"
+import "io"
+import "compress/gzip"
+
+import "github.com/klauspost/compress/zstd"
+import "github.com/ulikunitz/xz"
+
+// Magic numbers of the supported compression formats.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// compressed reports whether magic starts with the magic number of a
+// supported compression format.
+func compressed(magic []byte) bool {
+	return bytes.HasPrefix(magic, gzipMagic) || bytes.HasPrefix(magic, zstdMagic) || bytes.HasPrefix(magic, xzMagic)
+}
+
+// decompress detects gzip, zstd and xz compressed input by its magic bytes
+// and returns a reader of the decompressed data. Uncompressed input is
+// returned unchanged.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		// a single-threaded decoder runs synchronously and needs no Close
+		return zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+	case bytes.HasPrefix(magic, xzMagic):
+		return xz.NewReader(br)
+	}
+	return br, nil
+}
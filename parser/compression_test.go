@@ -0,0 +1,99 @@
+package parser
+
+import "testing"
+import "bytes"
+import "io"
+import "io/ioutil"
+import "os"
+import "compress/gzip"
+
+import "github.com/klauspost/compress/zstd"
+import "github.com/ulikunitz/xz"
+
+// compresses the given file with the compressor and writes it to target
+func writeCompressed(t *testing.T, source, target string, compressor func(io.Writer) (io.WriteCloser, error)) {
+	buf, err := ioutil.ReadFile(source)
+	if err != nil {
+		t.Fatalf("input file not available")
+	}
+
+	var out bytes.Buffer
+	w, err := compressor(&out)
+	if err != nil {
+		t.Fatalf("Couldn't create compressor: %v", err)
+	}
+	w.Write(buf)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Couldn't compress %v: %v", source, err)
+	}
+	if err := ioutil.WriteFile(target, out.Bytes(), 0666); err != nil {
+		t.Fatalf("Couldn't write %v: %v", target, err)
+	}
+}
+
+var compressors = map[string]func(io.Writer) (io.WriteCloser, error){
+	"gz": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+	"zst": func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	},
+	"xz": func(w io.Writer) (io.WriteCloser, error) {
+		return xz.NewWriter(w)
+	},
+}
+
+func TestParseCompressedUBC(t *testing.T) {
+	Init()
+
+	for suffix, compressor := range compressors {
+		target := "ubcTesting." + suffix
+		writeCompressed(t, "ubcTesting", target, compressor)
+		defer os.Remove(target)
+
+		outchan := make(chan []byte, 10000)
+		ubcP, err := NewUBCParser(target, outchan)
+		if err != nil {
+			t.Fatalf("Couldn't initialize UBCParser for %v: %v", target, err)
+		}
+		if err := ubcP.ParseFile(); err != nil {
+			t.Fatalf("Error during parsing %v: %v", target, err)
+		}
+		if len(outchan) != 53 {
+			t.Fatalf("Wrong number of protobufs in %v: got %v, expected: 53", target, len(outchan))
+		}
+	}
+}
+
+func TestParseCompressedProto(t *testing.T) {
+	testdata := protoParseTestInit(t)
+
+	for suffix, compressor := range compressors {
+		target := testdata["FileWith4Chunks"] + "." + suffix
+		writeCompressed(t, testdata["FileWith4Chunks"], target, compressor)
+		defer os.Remove(target)
+
+		messageChan := make(chan []byte, 1000)
+		protoParser, err := NewProtoParser(target, messageChan)
+		if err != nil {
+			t.Fatalf("Couldn't initialize ProtoParser for %v: %v", target, err)
+		}
+		if err := protoParser.ParseFile(); err != nil {
+			t.Fatalf("Error during parsing %v: %v", target, err)
+		}
+		if len(messageChan) != 5 {
+			t.Fatalf("Wrong number of messages in %v: got %v, expected: 5", target, len(messageChan))
+		}
+	}
+}
+
+func TestDecompressPlain(t *testing.T) {
+	// short, uncompressed input must pass unchanged
+	r, err := decompress(bytes.NewReader([]byte{0x1f}))
+	if err != nil {
+		t.Fatalf("Couldn't read plain input: %v", err)
+	}
+	if buf, _ := ioutil.ReadAll(r); !bytes.Equal(buf, []byte{0x1f}) {
+		t.Fatalf("Plain input was changed: got %x", buf)
+	}
+}
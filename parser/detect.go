@@ -0,0 +1,225 @@
+package parser
+
+import "os"
+import "bufio"
+import "bytes"
+import "errors"
+import "fmt"
+import "io"
+import "regexp"
+import "strconv"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// The number of bytes DetectFormat inspects.
+const sniffSize = 64 * 1024
+
+// Detections with a lower confidence are rejected by OpenAuto.
+const MinDetectionConfidence = 0.5
+
+var ErrUnknownFormat = errors.New("unknown trace format")
+
+// Detection is the result of a trace format detection.
+type Detection struct {
+	Format     string  // one of the Format* constants, empty if nothing matched
+	Confidence float64 // between 0 (no match) and 1 (certain)
+}
+
+var ubcHashLine = regexp.MustCompile("^[0-9a-fz]+:[0-9]+$")
+
+// DetectFormat inspects the first bytes of br without consuming them and
+// returns the most likely trace format. The input must already be
+// decompressed.
+func DetectFormat(br *bufio.Reader) (Detection, error) {
+	buf, err := br.Peek(sniffSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return Detection{}, err
+	}
+
+	best := Detection{}
+	for _, d := range []Detection{
+		{FormatUBC, sniffUBC(buf)},
+		{FormatProto, sniffProto(buf)},
+		{FormatLegacy, sniffLegacy(buf)},
+	} {
+		if d.Confidence > best.Confidence {
+			best = d
+		}
+	}
+	return best, nil
+}
+
+// DetectFile returns the most likely format of the (possibly compressed)
+// trace file at filepath.
+func DetectFile(filepath string) (Detection, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return Detection{}, err
+	}
+	defer f.Close()
+
+	r, err := decompress(f)
+	if err != nil {
+		return Detection{}, err
+	}
+	return DetectFormat(bufio.NewReaderSize(r, sniffSize))
+}
+
+// OpenAuto detects the format of the trace file at filepath and creates the
+// matching parser. Fails with ErrUnknownFormat if no format was detected with
+// at least MinDetectionConfidence.
+func OpenAuto(filepath string, outChan chan<- []byte) (TraceParser, Detection, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, Detection{}, err
+	}
+
+	r, err := decompress(f)
+	if err != nil {
+		f.Close()
+		return nil, Detection{}, err
+	}
+	br := bufio.NewReaderSize(r, sniffSize)
+
+	d, err := DetectFormat(br)
+	if err != nil {
+		f.Close()
+		return nil, d, err
+	} else if d.Confidence < MinDetectionConfidence {
+		f.Close()
+		return nil, d, fmt.Errorf("%v: %v (best guess %q with confidence %.2f)", filepath, ErrUnknownFormat, d.Format, d.Confidence)
+	}
+
+	p, err := OpenReader(d.Format, filepath, br, outChan)
+	if err != nil {
+		f.Close()
+		return nil, d, err
+	}
+	if o, ok := p.(fileOwner); ok {
+		o.own(f)
+	}
+	return p, d, nil
+}
+
+// splits the printable text at the beginning of buf into lines. The last,
+// possibly incomplete line is dropped unless buf holds the whole trace.
+func textLines(buf []byte) ([]string, bool) {
+	for _, b := range buf {
+		if (b < 0x20 && b != '\n' && b != '\r' && b != '\t') || b == 0x7f {
+			return nil, false
+		}
+	}
+
+	lines := bytes.Split(buf, []byte("\n"))
+	if len(buf) == sniffSize {
+		lines = lines[:len(lines)-1]
+	}
+	result := make([]string, len(lines))
+	for i := range lines {
+		result[i] = string(bytes.TrimSpace(lines[i]))
+	}
+	return result, true
+}
+
+// UBC traces are text: a header block terminated by an empty line, followed
+// by file entries starting with three "hash:number" lines.
+func sniffUBC(buf []byte) float64 {
+	if len(buf) == 0 {
+		return 0
+	}
+	lines, ok := textLines(buf)
+	if !ok || len(lines) == 0 || len(lines[0]) == 0 {
+		return 0
+	}
+
+	hashLines := func(lines []string) int {
+		n := 0
+		for n < len(lines) && n < 3 && ubcHashLine.MatchString(lines[n]) {
+			n++
+		}
+		return n
+	}
+
+	if hashLines(lines) == 3 { // file entries without header
+		return 0.5
+	}
+	for i, l := range lines {
+		if len(l) == 0 {
+			switch hashLines(lines[i+1:]) {
+			case 3:
+				return 1
+			case 0:
+				return 0.2
+			default:
+				return 0.7
+			}
+		}
+	}
+	return 0.1
+}
+
+// fs-c traces start with a varint-delimited File message followed by
+// File.chunkCount varint-delimited Chunk messages.
+func sniffProto(buf []byte) float64 {
+	size, n := proto.DecodeVarint(buf)
+	if n == 0 {
+		return 0
+	} else if size == 0 {
+		return 0.1
+	} else if uint64(len(buf)-n) < size {
+		return 0
+	}
+
+	f := new(traceProto.File)
+	if err := f.Unmarshal(buf[n : n+int(size)]); err != nil {
+		return 0
+	} else if f.Filename == nil || len(f.XXX_unrecognized) > 0 {
+		return 0.3
+	}
+	buf = buf[n+int(size):]
+
+	for i := uint32(0); i < f.GetChunkCount() && i < 4; i++ {
+		size, n = proto.DecodeVarint(buf)
+		if n == 0 || uint64(len(buf)-n) < size {
+			return 0.8 // sniffed data ends within the chunks
+		}
+		c := new(traceProto.Chunk)
+		if err := c.Unmarshal(buf[n : n+int(size)]); err != nil || len(c.Fp) == 0 {
+			return 0.3
+		}
+		buf = buf[n+int(size):]
+	}
+	return 1
+}
+
+// Legacy traces start with a tab separated "filename, size[, type]" line
+// followed by 24 byte chunk records, each prefixed by its size. A zero byte
+// terminates the chunk list.
+func sniffLegacy(buf []byte) float64 {
+	end := bytes.IndexByte(buf, '\n')
+	if end < 0 {
+		return 0
+	}
+	elements := bytes.Split(buf[:end], []byte("\t"))
+	if len(elements) != 2 && len(elements) != 3 {
+		return 0
+	} else if _, err := strconv.ParseInt(string(elements[1]), 10, 64); err != nil {
+		return 0
+	}
+
+	records := buf[end+1:]
+	switch {
+	case len(records) == 0:
+		return 0.5
+	case records[0] == 0:
+		return 0.9
+	case records[0] != 24:
+		return 0.1
+	case len(records) < 26:
+		return 0.8
+	case records[25] == 24 || records[25] == 0:
+		return 1
+	}
+	return 0.3
+}
@@ -0,0 +1,102 @@
+package parser
+
+import "testing"
+import "bufio"
+import "bytes"
+import "io/ioutil"
+import "os"
+
+// a legacy trace with one file of two chunks
+func legacyTestTrace() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("some/file\t8192\ttxt\n")
+	for i := 0; i < 2; i++ {
+		buf.WriteByte(24)
+		buf.Write([]byte{0x00, 0x10, 0x00, 0x00}) // 4096, little endian
+		fp := make([]byte, 20)
+		fp[0] = byte(i)
+		buf.Write(fp)
+	}
+	buf.WriteString("\x00\n")
+	return buf.Bytes()
+}
+
+func detect(t *testing.T, buf []byte) Detection {
+	d, err := DetectFormat(bufio.NewReader(bytes.NewReader(buf)))
+	if err != nil {
+		t.Fatalf("Error during format detection: %v", err)
+	}
+	return d
+}
+
+func TestDetectFormat(t *testing.T) {
+	Init()
+	testdata := protoParseTestInit(t)
+
+	ubc, _ := ioutil.ReadFile("ubcTesting")
+	if d := detect(t, ubc); d.Format != FormatUBC || d.Confidence != 1 {
+		t.Fatalf("Wrong detection for ubc trace: %+v", d)
+	}
+
+	simple, _ := ioutil.ReadFile("ubcSimpleTesting")
+	if d := detect(t, simple); d.Format != FormatUBC || d.Confidence != 0.5 {
+		t.Fatalf("Wrong detection for headerless ubc trace: %+v", d)
+	}
+
+	for _, name := range []string{testdata["FileWith4Chunks"], testdata["emptyFile"]} {
+		buf, _ := ioutil.ReadFile(name)
+		if d := detect(t, buf); d.Format != FormatProto || d.Confidence != 1 {
+			t.Fatalf("Wrong detection for proto trace %v: %+v", name, d)
+		}
+	}
+
+	if d := detect(t, legacyTestTrace()); d.Format != FormatLegacy || d.Confidence != 1 {
+		t.Fatalf("Wrong detection for legacy trace: %+v", d)
+	}
+
+	if d := detect(t, []byte{0xff, 0x00, 0x13, 0x37}); d.Confidence >= MinDetectionConfidence {
+		t.Fatalf("Random data was detected: %+v", d)
+	}
+	if d := detect(t, nil); d.Confidence != 0 {
+		t.Fatalf("Empty input was detected: %+v", d)
+	}
+}
+
+func TestDetectCompressedFile(t *testing.T) {
+	testdata := protoParseTestInit(t)
+	target := testdata["FileWith4Chunks"] + ".gz"
+	writeCompressed(t, testdata["FileWith4Chunks"], target, compressors["gz"])
+	defer os.Remove(target)
+
+	if d, err := DetectFile(target); err != nil {
+		t.Fatalf("Error during format detection: %v", err)
+	} else if d.Format != FormatProto {
+		t.Fatalf("Wrong detection for compressed proto trace: %+v", d)
+	}
+}
+
+func TestOpenAuto(t *testing.T) {
+	Init()
+
+	outchan := make(chan []byte, 10000)
+	p, d, err := OpenAuto("ubcTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't open ubc trace: %v", err)
+	} else if d.Format != FormatUBC {
+		t.Fatalf("Wrong detection: %+v", d)
+	}
+	if err := p.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+	if len(outchan) != 53 {
+		t.Fatalf("Wrong number of protobufs: got %v, expected: 53", len(outchan))
+	}
+
+	if err := ioutil.WriteFile("unknownTesting", []byte{0xff, 0x00, 0x13, 0x37}, 0666); err != nil {
+		t.Fatalf("Couldn't write test file: %v", err)
+	}
+	defer os.Remove("unknownTesting")
+	if _, _, err := OpenAuto("unknownTesting", outchan); err == nil {
+		t.Fatal("OpenAuto succeeded for unknown format")
+	}
+}
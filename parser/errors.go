@@ -0,0 +1,33 @@
+package parser
+
+import "fmt"
+import "io"
+
+// ParseError describes a record of a trace that couldn't be read or decoded.
+type ParseError struct {
+	Filename string // the parsed trace file
+	Offset   int64  // byte offset of the faulty data within the trace
+	Record   int    // number of the file entry the error occurred in, starting at 0
+	Err      error  // the cause
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v: file entry %v at byte offset %v: %v", e.Filename, e.Record, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// countingReader counts the bytes read from the underlying reader. Together
+// with the number of buffered bytes it gives the current offset in a trace.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
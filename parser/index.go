@@ -0,0 +1,231 @@
+package parser
+
+import "os"
+import "bufio"
+import "io"
+import "fmt"
+import "sort"
+import "encoding/binary"
+
+// The suffix of index files next to their trace, e.g. "trace.fscidx".
+const IndexSuffix = ".fscidx"
+
+// An index file starts with indexMagic followed by fixed-size records: the
+// file ordinal (8 bytes), the byte offset (8 bytes), the chunk count (4 bytes)
+// and the cumulative bytes (8 bytes), all little endian.
+var indexMagic = []byte("FSCIDX\x00\x01")
+
+const indexRecordSize = 28
+
+// IndexEntry locates a file entry within an uncompressed fs-c trace.
+type IndexEntry struct {
+	File       int    // ordinal of the file entry
+	Offset     int64  // byte offset of the file message
+	ChunkCount uint32 // chunks of the file entry
+	Bytes      uint64 // sum of the file sizes of all preceding file entries
+}
+
+// Index is the index of an fs-c trace. It may be sparse, i.e. cover only
+// every n-th file entry.
+type Index struct {
+	Entries []IndexEntry // sorted by File and Offset
+}
+
+// ReadIndex reads an index written by IndexWriter.
+func ReadIndex(r io.Reader) (*Index, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != string(indexMagic) {
+		return nil, fmt.Errorf("not an fs-c index")
+	}
+
+	ix := new(Index)
+	var record [indexRecordSize]byte
+	for {
+		if _, err := io.ReadFull(br, record[:]); err == io.EOF {
+			return ix, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("couldn't read index entry %v: %v", len(ix.Entries), err)
+		}
+
+		e := IndexEntry{
+			File:       int(binary.LittleEndian.Uint64(record[0:])),
+			Offset:     int64(binary.LittleEndian.Uint64(record[8:])),
+			ChunkCount: binary.LittleEndian.Uint32(record[16:]),
+			Bytes:      binary.LittleEndian.Uint64(record[20:]),
+		}
+		if n := len(ix.Entries); n > 0 && (e.File <= ix.Entries[n-1].File || e.Offset <= ix.Entries[n-1].Offset) {
+			return nil, fmt.Errorf("index entry %v isn't sorted", n)
+		}
+		ix.Entries = append(ix.Entries, e)
+	}
+}
+
+// LoadIndex reads the index file at filepath.
+func LoadIndex(filepath string) (*Index, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadIndex(f)
+}
+
+// Lookup returns the last indexed entry of file n or a file before n.
+func (ix *Index) Lookup(n int) (IndexEntry, bool) {
+	i := sort.Search(len(ix.Entries), func(i int) bool { return ix.Entries[i].File > n })
+	if i == 0 {
+		return IndexEntry{}, false
+	}
+	return ix.Entries[i-1], true
+}
+
+// LookupOffset returns the first indexed entry at or after offset.
+func (ix *Index) LookupOffset(offset int64) (IndexEntry, bool) {
+	i := sort.Search(len(ix.Entries), func(i int) bool { return ix.Entries[i].Offset >= offset })
+	if i == len(ix.Entries) {
+		return IndexEntry{}, false
+	}
+	return ix.Entries[i], true
+}
+
+// IndexWriter writes index files.
+type IndexWriter struct {
+	file   *os.File // nil if the writer doesn't own the output
+	output *bufio.Writer
+
+	interval int  // only every interval-th file entry is indexed
+	entries  int  // number of entries written
+	started  bool // the magic was written
+}
+
+// NewIndexWriter creates a buffered IndexWriter on top of w. Closing the
+// IndexWriter doesn't close w.
+func NewIndexWriter(w io.Writer) *IndexWriter {
+	return &IndexWriter{output: bufio.NewWriter(w), interval: 1}
+}
+
+// CreateIndexWriter creates or truncates the file at filepath and returns an
+// IndexWriter for it.
+func CreateIndexWriter(filepath string) (*IndexWriter, error) {
+	f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	w := NewIndexWriter(f)
+	w.file = f
+	return w, nil
+}
+
+// SetInterval makes the writer index only every n-th file entry, starting
+// with the first one. Seeking to other entries skips them from the closest
+// indexed entry.
+func (w *IndexWriter) SetInterval(n int) {
+	if n < 1 {
+		n = 1
+	}
+	w.interval = n
+}
+
+// Entries returns the number of entries written so far.
+func (w *IndexWriter) Entries() int {
+	return w.entries
+}
+
+func (w *IndexWriter) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	_, err := w.output.Write(indexMagic)
+	return err
+}
+
+// Write adds the entry to the index unless it isn't covered by the interval.
+// Entries must be written in the order of the trace.
+func (w *IndexWriter) Write(e IndexEntry) error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	if e.File%w.interval != 0 {
+		return nil
+	}
+
+	var record [indexRecordSize]byte
+	binary.LittleEndian.PutUint64(record[0:], uint64(e.File))
+	binary.LittleEndian.PutUint64(record[8:], uint64(e.Offset))
+	binary.LittleEndian.PutUint32(record[16:], e.ChunkCount)
+	binary.LittleEndian.PutUint64(record[20:], e.Bytes)
+	if _, err := w.output.Write(record[:]); err != nil {
+		return err
+	}
+	w.entries++
+	return nil
+}
+
+// Close flushes the writer and closes the output file if it was created by
+// CreateIndexWriter.
+func (w *IndexWriter) Close() error {
+	err := w.start()
+	if ferr := w.output.Flush(); err == nil {
+		err = ferr
+	}
+	if w.file != nil {
+		if cerr := w.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// IndexProtoFile indexes the uncompressed fs-c trace at tracePath and writes
+// the index to indexPath. Returns the number of file entries of the trace.
+func IndexProtoFile(tracePath, indexPath string, interval int) (int, error) {
+	f, err := os.Open(tracePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	w, err := CreateIndexWriter(indexPath)
+	if err != nil {
+		return 0, err
+	}
+	w.SetInterval(interval)
+	files, err := IndexProtoTrace(tracePath, f, w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return files, err
+}
+
+// IndexProtoTrace indexes the uncompressed fs-c trace read from r. The chunks
+// are skipped without decoding them. Returns the number of file entries of the
+// trace and a *ParseError if the trace is malformed.
+func IndexProtoTrace(name string, r io.Reader, w *IndexWriter) (int, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(xzMagic)); compressed(magic) {
+		return 0, fmt.Errorf("%v: compressed traces can't be indexed", name)
+	}
+	p, err := NewProtoParserFromReader(name, br, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var bytes uint64
+	for {
+		start := p.offset()
+		f, err := p.skipFileEntry()
+		if err == io.EOF {
+			return p.record, nil
+		} else if err != nil {
+			return p.record, &ParseError{Filename: name, Offset: start, Record: p.record, Err: err}
+		}
+
+		if err := w.Write(IndexEntry{File: p.record, Offset: start, ChunkCount: f.GetChunkCount(), Bytes: bytes}); err != nil {
+			return p.record, err
+		}
+		bytes += f.GetFsize()
+		p.record++
+	}
+}
@@ -0,0 +1,212 @@
+package parser
+
+import "testing"
+import "bytes"
+import "compress/gzip"
+import "fmt"
+import "io/ioutil"
+import "path/filepath"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// returns n synthetic file entries. File i is named "file <i>", has 100*i
+// bytes, the label "even" if i is even and i%3 chunks of 50 bytes with the
+// fingerprint {i, j}. The second chunk of a file is a zero chunk.
+func testEntries(n int) []*FileEntry {
+	entries := make([]*FileEntry, n)
+	for i := range entries {
+		f := &traceProto.File{Filename: proto.String(fmt.Sprintf("file %v", i)), Fsize: proto.Uint64(uint64(100 * i))}
+		if i%2 == 0 {
+			f.Label = proto.String("even")
+		}
+		e := &FileEntry{File: f}
+		for j := 0; j < i%3; j++ {
+			e.Chunks = append(e.Chunks, &traceProto.Chunk{Fp: []byte{byte(i), byte(j)}, Csize: proto.Uint32(50), Zero: proto.Bool(j == 1)})
+		}
+		entries[i] = e
+	}
+	return entries
+}
+
+// writes the entries to a new trace at path. If ix isn't nil, the index of
+// the trace is written to it.
+func writeTestTrace(t *testing.T, path string, entries []*FileEntry, ix *IndexWriter) {
+	w, err := CreateTraceWriter(path)
+	if err != nil {
+		t.Fatalf("Couldn't create test trace: %v", err)
+	}
+	if ix != nil {
+		w.SetIndex(ix)
+	}
+	for i, e := range entries {
+		if err := w.WriteEntry(e); err != nil {
+			t.Fatalf("Couldn't write test entry %v: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Couldn't write test trace: %v", err)
+	}
+}
+
+// writes a trace of the n test entries to a temporary directory and returns
+// its path and its index as written by the TraceWriter
+func writeIndexedTrace(t *testing.T, n int) (string, *Index) {
+	trace := filepath.Join(t.TempDir(), "indexTesting")
+	var ix bytes.Buffer
+	iw := NewIndexWriter(&ix)
+	writeTestTrace(t, trace, testEntries(n), iw)
+	if err := iw.Close(); err != nil {
+		t.Fatalf("Couldn't write index: %v", err)
+	}
+
+	index, err := ReadIndex(&ix)
+	if err != nil {
+		t.Fatalf("Couldn't read index: %v", err)
+	}
+	return trace, index
+}
+
+// parses the trace at path from the position given by seek
+func parseFrom(t *testing.T, path string, seek func(p *ProtoParser) error) []*FileEntry {
+	p, err := NewProtoParser(path, nil)
+	if err != nil {
+		t.Fatalf("Couldn't open trace: %v", err)
+	}
+	if err := seek(p); err != nil {
+		t.Fatalf("Couldn't seek: %v", err)
+	}
+	out := make(chan *FileEntry, 100)
+	if err := p.ParseRecords(out); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+	entries := make([]*FileEntry, 0)
+	for e := range out {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestIndex(t *testing.T) {
+	trace, written := writeIndexedTrace(t, 10)
+
+	files, err := IndexProtoFile(trace, trace+IndexSuffix, 1)
+	if err != nil {
+		t.Fatalf("Couldn't index trace: %v", err)
+	} else if files != 10 {
+		t.Fatalf("Wrong number of files: got %v, expected: 10", files)
+	}
+	index, err := LoadIndex(trace + IndexSuffix)
+	if err != nil {
+		t.Fatalf("Couldn't load index: %v", err)
+	}
+
+	if len(index.Entries) != 10 || len(written.Entries) != 10 {
+		t.Fatalf("Wrong number of index entries: got %v and %v, expected: 10", len(index.Entries), len(written.Entries))
+	}
+	for i, e := range index.Entries {
+		if e != written.Entries[i] {
+			t.Fatalf("Index entries %v differ: %+v vs. %+v", i, e, written.Entries[i])
+		} else if e.File != i || e.ChunkCount != uint32(i%3) || e.Bytes != uint64(100*i*(i-1)/2) {
+			t.Fatalf("Wrong index entry %v: %+v", i, e)
+		}
+	}
+	if index.Entries[0].Offset != 0 {
+		t.Fatalf("First entry has offset %v", index.Entries[0].Offset)
+	}
+
+	for _, e := range index.Entries {
+		entries := parseFrom(t, trace, func(p *ProtoParser) error { return p.SeekEntry(e) })
+		if len(entries) != 10-e.File {
+			t.Fatalf("Wrong number of entries from file %v: %v", e.File, len(entries))
+		} else if name := entries[0].File.GetFilename(); name != fmt.Sprintf("file %v", e.File) {
+			t.Fatalf("Seeking to file %v gave %v", e.File, name)
+		}
+	}
+}
+
+func TestIndexSparse(t *testing.T) {
+	trace, _ := writeIndexedTrace(t, 10)
+
+	if _, err := IndexProtoFile(trace, trace+IndexSuffix, 4); err != nil {
+		t.Fatalf("Couldn't index trace: %v", err)
+	}
+	index, err := LoadIndex(trace + IndexSuffix)
+	if err != nil {
+		t.Fatalf("Couldn't load index: %v", err)
+	} else if len(index.Entries) != 3 || index.Entries[2].File != 8 {
+		t.Fatalf("Wrong sparse index: %+v", index.Entries)
+	}
+
+	for n := 0; n < 10; n++ {
+		entries := parseFrom(t, trace, func(p *ProtoParser) error { return p.SeekFile(index, n) })
+		if len(entries) != 10-n || entries[0].File.GetFilename() != fmt.Sprintf("file %v", n) {
+			t.Fatalf("Seeking to file %v gave %v entries starting with %v", n, len(entries), entries[0].File.GetFilename())
+		}
+	}
+
+	p, _ := NewProtoParser(trace, nil)
+	if err := p.SeekFile(index, 11); err == nil {
+		t.Fatal("Seeking beyond the last file succeeded")
+	}
+
+	// from an offset within file 1, the next indexed entry is file 4
+	entries := parseFrom(t, trace, func(p *ProtoParser) error { return p.SeekOffset(index, 1) })
+	if len(entries) != 6 || entries[0].File.GetFilename() != "file 4" {
+		t.Fatalf("Seeking to offset 1 gave %v entries", len(entries))
+	}
+	p, _ = NewProtoParser(trace, nil)
+	if err := p.SeekOffset(index, index.Entries[2].Offset+1); err == nil {
+		t.Fatal("Seeking beyond the last indexed offset succeeded")
+	}
+}
+
+func TestIndexCompressed(t *testing.T) {
+	trace, index := writeIndexedTrace(t, 3)
+
+	buf, _ := ioutil.ReadFile(trace)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(buf)
+	zw.Close()
+	ioutil.WriteFile(trace+".gz", gz.Bytes(), 0666)
+
+	if _, err := IndexProtoTrace(trace+".gz", bytes.NewReader(gz.Bytes()), NewIndexWriter(ioutil.Discard)); err == nil {
+		t.Fatal("Indexing a compressed trace succeeded")
+	}
+	p, _ := NewProtoParser(trace+".gz", nil)
+	if err := p.SeekFile(index, 1); err == nil {
+		t.Fatal("Seeking in a compressed trace succeeded")
+	}
+	p, _ = NewProtoParserFromReader("in-memory", bytes.NewBuffer(buf), nil)
+	if err := p.SeekEntry(IndexEntry{}); err == nil {
+		t.Fatal("Seeking in an unseekable trace succeeded")
+	}
+}
+
+func TestReadIndexErrors(t *testing.T) {
+	if _, err := ReadIndex(bytes.NewReader([]byte("no index"))); err == nil {
+		t.Fatal("Reading a file without magic succeeded")
+	}
+
+	var buf bytes.Buffer
+	w := NewIndexWriter(&buf)
+	w.Write(IndexEntry{File: 0, Offset: 0})
+	w.Write(IndexEntry{File: 1, Offset: 20})
+	w.Close()
+	if ix, err := ReadIndex(bytes.NewReader(buf.Bytes())); err != nil || len(ix.Entries) != 2 {
+		t.Fatalf("Couldn't read index: %v", err)
+	}
+	if _, err := ReadIndex(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Fatal("Reading a truncated index succeeded")
+	}
+
+	buf.Reset()
+	w = NewIndexWriter(&buf)
+	w.Write(IndexEntry{File: 1, Offset: 20})
+	w.Write(IndexEntry{File: 0, Offset: 0})
+	w.Close()
+	if _, err := ReadIndex(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("Reading an unsorted index succeeded")
+	}
+}
@@ -2,86 +2,171 @@ package parser
 
 import "os"
 import "bufio"
+import "context"
 import "io"
 import "strings"
 import "strconv"
+import "fmt"
+import "encoding/binary"
 
+import "github.com/gogo/protobuf/proto"
 import "github.com/jkaiser/dedup_tools/traceProto"
 
-import proto "code.google.com/p/goprotobuf/proto"
-import log "github.com/cihub/seelog"
+// The layout of the chunk records of legacy traces: a record size byte
+// followed by the chunk size (4 bytes, little endian) and a 20 byte
+// fingerprint. A zero size byte terminates the chunk list; the rest of its
+// line up to the newline is ignored.
+const (
+	legacyRecordSize   = 24
+	legacyFpSize       = 20
+	legacyChunkListEnd = 0
+	legacySizeLen      = legacyRecordSize - legacyFpSize
+)
+
+// The default limit of the chunk size of legacy traces. Chunks larger than
+// this are illegal.
+const DefaultLegacyMaxChunkSize = 64 * 1024
 
 type LegacyParser struct {
-	filename   string
-	file       *bufio.Reader
-	outputChan chan<- []byte
+	filename string
+	file     *bufio.Reader
+	counter  *countingReader
+	emitter
+
+	chunks       []*traceProto.Chunk
+	partial      bool   // a chunk of the current file was skipped
+	maxChunkSize uint32 // 0 means no limit
+	record       int    // number of the current file entry
+	err          error  // the error that stopped the parsing
+	fileErrors   []*ParseError
+}
 
-	chunks    []*traceProto.Chunk
-	msgBuffer *proto.Buffer
+func NewLegacyParser(filepath string, outChan chan<- []byte) (*LegacyParser, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	parser, err := NewLegacyParserFromReader(filepath, f, outChan)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	parser.own(f)
+	return parser, nil
 }
 
-func NewLegacyParser(filepath string, outChan chan<- []byte) *LegacyParser {
+// NewLegacyParserFromReader creates a parser that reads the trace from r. The
+// name is used in error messages only.
+func NewLegacyParserFromReader(name string, r io.Reader, outChan chan<- []byte) (*LegacyParser, error) {
 	parser := new(LegacyParser)
-	parser.filename = filepath
+	parser.filename = name
 	parser.outputChan = outChan
-	parser.msgBuffer = proto.NewBuffer(nil)
+	parser.maxChunkSize = DefaultLegacyMaxChunkSize
 
-	if f, err := os.Open(filepath); err != nil {
-		log.Error("Couldn't open file to parse: ", err)
-		return nil
+	if r, err := decompress(r); err != nil {
+		return nil, err
 	} else {
-		parser.file = bufio.NewReaderSize(f, 4*1024*1024)
-		return parser
+		parser.counter = &countingReader{r: r}
+		parser.file = bufio.NewReaderSize(parser.counter, 4*1024*1024)
+		return parser, nil
 	}
 }
 
-func (p *LegacyParser) helperChunkSize(buffer []byte, offset int) int64 {
+// SetMaxChunkSize sets the maximum chunk size. Larger chunks are skipped and
+// recorded in FileErrors. 0 disables the limit.
+func (p *LegacyParser) SetMaxChunkSize(size uint32) {
+	p.maxChunkSize = size
+}
+
+// FileErrors returns the errors of file entries that were parsed nevertheless.
+// The affected entries are marked as partial.
+func (p *LegacyParser) FileErrors() []*ParseError {
+	return p.fileErrors
+}
+
+// offset returns the number of bytes of the trace consumed so far.
+func (p *LegacyParser) offset() int64 {
+	return p.counter.n - int64(p.file.Buffered())
+}
+
+func (p *LegacyParser) fail(offset int64, format string, args ...interface{}) {
+	p.failErr(offset, fmt.Errorf(format, args...))
+}
+
+func (p *LegacyParser) failErr(offset int64, err error) {
+	p.err = &ParseError{Filename: p.filename, Offset: offset, Record: p.record, Err: err}
+}
+
+// Parses the whole file. Returns a *ParseError if the trace is malformed.
+func (p *LegacyParser) ParseFile() error {
+	return p.ParseFileContext(context.Background())
+}
+
+// ParseFileContext parses the whole file until ctx is cancelled. The returned
+// *ParseError wraps ctx.Err() if the parsing was cancelled.
+func (p *LegacyParser) ParseFileContext(ctx context.Context) error {
+	p.start(ctx, nil)
+	p.parse()
+	p.finish()
+	return p.err
+}
 
-	result := int64(0)
-	i := int64(buffer[offset+3])
-	result = 256*result + i
-	i = int64(buffer[offset+2])
-	result = 256*result + i
-	i = int64(buffer[offset+1])
-	result = 256*result + i
-	i = int64(buffer[offset+0])
-	result = 256*result + i
+// Parses the whole file and sends the decoded file entries to out instead of
+// the output channel. Closes out when finished.
+func (p *LegacyParser) ParseRecords(out chan<- *FileEntry) error {
+	return p.ParseRecordsContext(context.Background(), out)
+}
 
-	return result
+// ParseRecordsContext is ParseRecords that stops when ctx is cancelled.
+func (p *LegacyParser) ParseRecordsContext(ctx context.Context, out chan<- *FileEntry) error {
+	p.start(ctx, out)
+	p.parse()
+	p.finish()
+	return p.err
 }
 
-// Parses the whole file
-func (p *LegacyParser) ParseFile() {
-	filecount := 0
-	for p.parseFileEntry() {
-		filecount++
+func (p *LegacyParser) parse() {
+	for {
+		if err := p.cancelled(); err != nil {
+			p.failErr(p.offset(), err)
+			return
+		}
+		if !p.parseFileEntry() {
+			return
+		}
+		p.record++
 	}
-	log.Info("Filecount in ParseFile() after finish ", filecount)
-	close(p.outputChan)
 }
 
 func (p *LegacyParser) parseFileEntry() bool {
 	f := new(traceProto.File)
 
+	start := p.offset()
 	line, err := p.file.ReadString('\n')
 	if err != nil {
-		if err == io.EOF {
-			return false
-		} else {
-			log.Error("parseFileEntry() p.ReadLine() error: ", err)
+		if err == io.EOF && len(line) == 0 {
 			return false
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
+		p.fail(start, "couldn't read file line: %v", err)
+		return false
 	}
 	line = strings.Trim(line, "\n")
 	elements := strings.Split(line, "\t")
 
 	if len(elements) != 2 && len(elements) != 3 {
-		log.Error("wrong number of elements: ", len(elements))
+		p.fail(start, "wrong number of elements in file line: %v", len(elements))
 		return false
 	}
 
 	filename := elements[0]
-	filesize, _ := strconv.ParseInt(elements[1], 10, 64)
+	filesize, err := strconv.ParseInt(elements[1], 10, 64)
+	if err != nil {
+		p.fail(start, "couldn't parse file size: %v", err)
+		return false
+	}
 
 	var filetype string
 	if len(elements) >= 3 {
@@ -93,129 +178,73 @@ func (p *LegacyParser) parseFileEntry() bool {
 	f.Fsize = proto.Uint64(uint64(filesize))
 	f.Type = proto.String(filetype)
 
-	chunkcount := 0
-	rsf := false
-	for ok, _ := p.parseChunks(); ok; ok, rsf = p.parseChunks() {
-		chunkcount++
+	// parse until the end of the chunk list
+	for p.parseChunks() {
 	}
-
-	if rsf {
-		log.Infof("Filename: %s, chunkcount: %d, filetype: %s", filename, chunkcount, filetype)
-
+	if p.err != nil {
+		return false
 	}
 
-	f.ChunkCount = proto.Uint32(uint32(chunkcount))
-	msg, _ := proto.Marshal(f)
-	p.outputChan <- msg
-	for _, c := range p.chunks {
-		cmsg, _ := proto.Marshal(c)
-		p.outputChan <- cmsg
-
+	f.ChunkCount = proto.Uint32(uint32(len(p.chunks)))
+	if p.partial {
+		f.Partial = proto.Bool(true)
 	}
+	chunks := p.chunks
 	p.chunks = nil
+	p.partial = false
+	if err := p.emit(f, chunks); err != nil {
+		p.failErr(start, err)
+		return false
+	}
 	return true
 
 }
 
-func (p *LegacyParser) parseChunks() (bool, bool) {
-	chunk := new(traceProto.Chunk)
-	rS, size, _ := p.file.ReadRune()
-	_ = size
-	recordSize := int32(rS)
-	if recordSize == -1 {
-		log.Info("Finished chunks. recordsize: ", recordSize)
-		return false, false
+// Parses the next chunk record. Returns false at the end of the chunk list or
+// if an error occurred.
+func (p *LegacyParser) parseChunks() bool {
+	start := p.offset()
+	recordSize, err := p.file.ReadByte()
+	if err == io.EOF { // trace ends after the last chunk
+		return false
+	} else if err != nil {
+		p.fail(start, "couldn't read chunk record size: %v", err)
+		return false
 	}
 
-	if recordSize == 0 {
-
-		p.file.ReadString('\n')
-
-		return false, false
+	switch recordSize {
+	case legacyChunkListEnd:
+		// like the original parser, skip anything up to the newline
+		if _, err := p.file.ReadString('\n'); err != nil && err != io.EOF {
+			p.fail(start, "couldn't read end of chunk list: %v", err)
+		}
+		return false
+	case legacyRecordSize:
+	default:
+		p.fail(start, "chunk record size is %v instead of %v", recordSize, legacyRecordSize)
+		return false
 	}
 
-	if recordSize != 24 {
-
-		log.Error("recordsize in parseChunks() != 24. recordsize == ", recordSize)
-
-		return false, true
-	}
-	buffer := make([]byte, 4)
-	k, err := p.file.Read(buffer)
-	if err != nil {
-		log.Error("Read(buffer) in parseChunks: ", err)
-	}
-	if k < 4 {
-		for dif := 4 - k; dif > 0; dif = 4 - k {
-			m, _ := p.file.Read(buffer[k:])
-			k = k + m
+	var record [legacyRecordSize]byte
+	if _, err := io.ReadFull(p.file, record[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
-
+		p.fail(start, "couldn't read chunk record: %v", err)
+		return false
 	}
-	chunksize := p.helperChunkSize(buffer, 0)
-	if chunksize >= 64*1024 || chunksize < 0 {
-		log.Error("Illegal chunksize: ", chunksize)
-		return false, false
-	} else {
-		fp := make([]byte, 20)
-		n, err := p.file.Read(fp)
-		if err != nil {
-			log.Error("Read(buffer) in parseChunks: ", err)
-		}
-		if n < 20 {
-			for dif := 20 - n; dif > 0; dif = 20 - n {
-				m, _ := p.file.Read(fp[n:])
-				n = n + m
-			}
-		}
-		chunk.Fp = make([]byte, 20)
-		copy(chunk.Fp, fp)
+	chunksize := binary.LittleEndian.Uint32(record[:legacySizeLen])
+	if p.maxChunkSize > 0 && chunksize > p.maxChunkSize {
+		p.fileErrors = append(p.fileErrors, &ParseError{Filename: p.filename, Offset: start, Record: p.record,
+			Err: fmt.Errorf("skipped chunk of illegal size %v (maximum %v)", chunksize, p.maxChunkSize)})
+		p.partial = true
+		return true
 	}
-	chunk.Csize = proto.Uint32(uint32(chunksize))
-	p.chunks = append(p.chunks, chunk)
-
-	return true, false
-}
 
-func (p *LegacyParser) parseNChunks(n uint32) bool {
-
-	var msgSize uint64
-	var err error
-
-	// read chunks
-	for i := uint32(0); i < n; i++ {
-
-		// varint
-		if msgSize, err = p.readNextVarint(); err != nil {
-			log.Error("Couldn't read next chunkMsg size: ", err)
-			return false
-		}
-
-		// msg
-		buf := make([]byte, msgSize)
-		if _, err := io.ReadFull(p.file, buf); err != nil {
-			log.Error("Could not read next ChunkMsg: ", err)
-			return false
-		}
-
-		p.outputChan <- buf
-	}
+	chunk := new(traceProto.Chunk)
+	chunk.Fp = append([]byte(nil), record[legacySizeLen:]...)
+	chunk.Csize = proto.Uint32(chunksize)
+	p.chunks = append(p.chunks, chunk)
 
 	return true
 }
-
-func (p *LegacyParser) readNextVarint() (uint64, error) {
-
-	buf := make([]byte, 0, 5)
-	for {
-		if b, err := p.file.ReadByte(); err != nil {
-			return 0, err
-		} else {
-			buf = append(buf, b)
-			n, consumed := proto.DecodeVarint(buf)
-			if (n != 0) || (consumed != 0) {
-				return n, err
-			}
-		}
-	}
-}
@@ -0,0 +1,282 @@
+package parser
+
+import "testing"
+import "bytes"
+import "encoding/hex"
+import "io/ioutil"
+import "os"
+
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// appends a legacy chunk record of the given size and fingerprint byte
+func writeLegacyChunk(buf *bytes.Buffer, size uint32, fpByte byte) {
+	buf.WriteByte(24)
+	buf.Write([]byte{byte(size), byte(size >> 8), byte(size >> 16), byte(size >> 24)})
+	buf.Write(bytes.Repeat([]byte{fpByte}, 20))
+}
+
+func parseLegacy(t *testing.T, trace []byte) ([]*FileEntry, error) {
+	p, err := NewLegacyParserFromReader("legacyTest", bytes.NewReader(trace), nil)
+	if err != nil {
+		t.Fatalf("Couldn't initialize LegacyParser: %v", err)
+	}
+	return parseLegacyWith(p)
+}
+
+func TestLegacyParseFile(t *testing.T) {
+	outchan := make(chan []byte, 100)
+	p, err := NewLegacyParserFromReader("legacyTest", bytes.NewReader(legacyTestTrace()), outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize LegacyParser: %v", err)
+	} else if err := p.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+
+	if len(outchan) != 3 {
+		t.Fatalf("Wrong number of messages: got %v, expected: 3", len(outchan))
+	}
+
+	f := new(traceProto.File)
+	if err := f.Unmarshal(<-outchan); err != nil {
+		t.Fatalf("Couldn't unmarshal file: %v", err)
+	} else if f.GetFilename() != "some/file" || f.GetFsize() != 8192 || f.GetType() != "txt" || f.GetChunkCount() != 2 {
+		t.Fatalf("Wrong file: %v", f)
+	}
+
+	for i := 0; i < 2; i++ {
+		c := new(traceProto.Chunk)
+		fp := make([]byte, 20)
+		fp[0] = byte(i)
+		if err := c.Unmarshal(<-outchan); err != nil {
+			t.Fatalf("Couldn't unmarshal chunk: %v", err)
+		} else if !bytes.Equal(c.Fp, fp) {
+			t.Fatalf("Chunk has wrong fp: got %s, expected: %s", hex.EncodeToString(c.Fp), hex.EncodeToString(fp))
+		} else if c.GetCsize() != 4096 {
+			t.Fatalf("Chunk has wrong size: got %v, expected: 4096", c.GetCsize())
+		}
+	}
+}
+
+func TestLegacyMultipleFiles(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("a\t100\n")
+	writeLegacyChunk(&buf, 60, 1)
+	writeLegacyChunk(&buf, 40, 2)
+	buf.WriteString("\x00\n")
+	buf.WriteString("empty\t0\n\x00\n")
+	buf.WriteString("c\t65535\tbin\n")
+	writeLegacyChunk(&buf, 65535, 3)
+	buf.WriteString("\x00\n")
+
+	entries, err := parseLegacy(t, buf.Bytes())
+	if err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	} else if len(entries) != 3 {
+		t.Fatalf("Wrong number of files: got %v, expected: 3", len(entries))
+	}
+
+	if e := entries[0]; e.File.GetFilename() != "a" || e.File.GetType() != "" || len(e.Chunks) != 2 || e.Chunks[1].GetCsize() != 40 {
+		t.Fatalf("Wrong first file: %v %v", e.File, e.Chunks)
+	} else if e := entries[1]; e.File.GetFilename() != "empty" || len(e.Chunks) != 0 || e.File.GetChunkCount() != 0 {
+		t.Fatalf("Wrong empty file: %v %v", e.File, e.Chunks)
+	} else if e := entries[2]; e.File.GetType() != "bin" || len(e.Chunks) != 1 || e.Chunks[0].GetCsize() != 65535 {
+		t.Fatalf("Wrong last file: %v %v", e.File, e.Chunks)
+	}
+}
+
+// the size byte and the chunk size bytes are binary, even above 0x7f
+func TestLegacyBinarySizes(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("a\t1000\n")
+	writeLegacyChunk(&buf, 0xe8c3, 0xff)
+	buf.WriteString("\x00\n")
+
+	entries, err := parseLegacy(t, buf.Bytes())
+	if err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	} else if c := entries[0].Chunks[0]; c.GetCsize() != 0xe8c3 || !bytes.Equal(c.Fp, bytes.Repeat([]byte{0xff}, 20)) {
+		t.Fatalf("Wrong chunk: %v", c)
+	}
+
+	// 0xc3 0xa8 is a valid UTF-8 sequence and used to be read as a single size
+	buf.Reset()
+	buf.WriteString("a\t1000\n\xc3\xa8")
+	if _, err := parseLegacy(t, buf.Bytes()); err == nil {
+		t.Fatal("Illegal record size was accepted")
+	} else if perr, ok := err.(*ParseError); !ok || perr.Offset != 7 {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestLegacyMissingTerminator(t *testing.T) {
+	trace := legacyTestTrace()
+	entries, err := parseLegacy(t, trace[:len(trace)-2])
+	if err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	} else if len(entries) != 1 || len(entries[0].Chunks) != 2 {
+		t.Fatalf("Wrong entries: %v", entries)
+	}
+}
+
+// anything between the end of the chunk list and the newline is skipped
+func TestLegacyChunkListEnd(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("a\t10\n")
+	writeLegacyChunk(&buf, 10, 1)
+	buf.WriteString("\x00\r\n")
+	buf.WriteString("b\t0\n\x00garbage\n")
+	buf.WriteString("c\t0\n\x00x")
+
+	entries, err := parseLegacy(t, buf.Bytes())
+	if err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	} else if len(entries) != 3 || len(entries[0].Chunks) != 1 || entries[1].File.GetFilename() != "b" || entries[2].File.GetFilename() != "c" {
+		t.Fatalf("Wrong entries: %v", entries)
+	}
+}
+
+func TestLegacyMalformed(t *testing.T) {
+	trace := legacyTestTrace()
+	for name, c := range map[string]struct {
+		trace  []byte
+		offset int64
+	}{
+		"truncated record":  {trace[:30], 19},
+		"record size":       {append([]byte("a\t1\n"), 23), 4},
+		"file line":         {[]byte("a\t1\tb\tc\n"), 0},
+		"file size":         {[]byte("a\tone\n"), 0},
+		"unterminated line": {[]byte("a\t1"), 0},
+	} {
+		_, err := parseLegacy(t, c.trace)
+		if perr, ok := err.(*ParseError); !ok {
+			t.Fatalf("%v: wrong error: %v", name, err)
+		} else if perr.Offset != c.offset {
+			t.Fatalf("%v: wrong offset: got %v, expected: %v", name, perr.Offset, c.offset)
+		}
+	}
+}
+
+func TestLegacyRegistry(t *testing.T) {
+	if err := ioutil.WriteFile("legacyTesting", legacyTestTrace(), 0666); err != nil {
+		t.Fatalf("Couldn't write test file: %v", err)
+	}
+	defer os.Remove("legacyTesting")
+
+	outchan := make(chan []byte, 100)
+	p, err := Open(FormatLegacy, "legacyTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't open legacy trace: %v", err)
+	} else if _, ok := p.(*LegacyParser); !ok {
+		t.Fatalf("Wrong parser type: %T", p)
+	} else if err := p.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	} else if len(outchan) != 3 {
+		t.Fatalf("Wrong number of messages: %v", len(outchan))
+	}
+
+	if _, err := NewLegacyParser("doesNotExist", outchan); err == nil {
+		t.Fatal("Opening a missing file succeeded")
+	}
+}
+
+func TestLegacyCompressed(t *testing.T) {
+	if err := ioutil.WriteFile("legacyTesting", legacyTestTrace(), 0666); err != nil {
+		t.Fatalf("Couldn't write test file: %v", err)
+	}
+	defer os.Remove("legacyTesting")
+
+	for suffix, compressor := range compressors {
+		target := "legacyTesting." + suffix
+		writeCompressed(t, "legacyTesting", target, compressor)
+		defer os.Remove(target)
+
+		outchan := make(chan []byte, 100)
+		p, err := NewLegacyParser(target, outchan)
+		if err != nil {
+			t.Fatalf("Couldn't initialize LegacyParser: %v", err)
+		} else if err := p.ParseFile(); err != nil {
+			t.Fatalf("%v: error during parsing: %v", suffix, err)
+		} else if len(outchan) != 3 {
+			t.Fatalf("%v: wrong number of messages: %v", suffix, len(outchan))
+		}
+	}
+}
+
+func TestLegacyMaxChunkSize(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("a\t200000\n")
+	writeLegacyChunk(&buf, 4096, 1)
+	writeLegacyChunk(&buf, 128*1024, 2)
+	writeLegacyChunk(&buf, 1024*1024, 3)
+	buf.WriteString("\x00\n")
+	buf.WriteString("b\t10\n")
+	writeLegacyChunk(&buf, 10, 4)
+	buf.WriteString("\x00\n")
+
+	// the default limit skips the large chunks, but parses all files
+	p, _ := NewLegacyParserFromReader("legacyTest", bytes.NewReader(buf.Bytes()), nil)
+	entries, err := parseLegacyWith(p)
+	if err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+	a, b := entries[0], entries[1]
+	if len(a.Chunks) != 1 || a.File.GetChunkCount() != 1 || !a.File.GetPartial() {
+		t.Fatalf("Large chunks weren't skipped: %v", a.File)
+	} else if len(b.Chunks) != 1 || b.File.GetPartial() {
+		t.Fatalf("Wrong second file: %v", b.File)
+	}
+	if errs := p.FileErrors(); len(errs) != 2 {
+		t.Fatalf("Wrong number of file errors: %v", errs)
+	} else if errs[0].Record != 0 || errs[0].Offset != int64(len("a\t200000\n")+25) {
+		t.Fatalf("Wrong file error: %v", errs[0])
+	}
+
+	// a higher limit keeps them
+	p, _ = NewLegacyParserFromReader("legacyTest", bytes.NewReader(buf.Bytes()), nil)
+	p.SetMaxChunkSize(2 * 1024 * 1024)
+	if entries, err = parseLegacyWith(p); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+	if a := entries[0]; len(a.Chunks) != 3 || a.Chunks[2].GetCsize() != 1024*1024 || a.File.GetPartial() {
+		t.Fatalf("Large chunks were skipped: %v", a.File)
+	} else if len(p.FileErrors()) != 0 {
+		t.Fatalf("Unexpected file errors: %v", p.FileErrors())
+	}
+
+	// 0 disables the limit
+	p, _ = NewLegacyParserFromReader("legacyTest", bytes.NewReader(buf.Bytes()), nil)
+	p.SetMaxChunkSize(0)
+	if entries, _ := parseLegacyWith(p); len(entries[0].Chunks) != 3 {
+		t.Fatalf("Large chunks were skipped without limit: %v", entries[0].File)
+	}
+
+	// the limit is the largest legal chunk size
+	for _, limit := range []uint32{DefaultLegacyMaxChunkSize, 1024 * 1024} {
+		buf.Reset()
+		buf.WriteString("a\t1000000\n")
+		writeLegacyChunk(&buf, limit, 1)
+		writeLegacyChunk(&buf, limit+1, 2)
+		buf.WriteString("\x00\n")
+
+		p, _ = NewLegacyParserFromReader("legacyTest", bytes.NewReader(buf.Bytes()), nil)
+		p.SetMaxChunkSize(limit)
+		if entries, err = parseLegacyWith(p); err != nil {
+			t.Fatalf("Error during parsing: %v", err)
+		}
+		if a := entries[0]; len(a.Chunks) != 1 || a.Chunks[0].GetCsize() != limit || !a.File.GetPartial() {
+			t.Fatalf("Wrong chunks for limit %v: %v", limit, a.Chunks)
+		} else if errs := p.FileErrors(); len(errs) != 1 || errs[0].Offset != int64(len("a\t1000000\n")+25) {
+			t.Fatalf("Wrong file errors for limit %v: %v", limit, errs)
+		}
+	}
+}
+
+func parseLegacyWith(p *LegacyParser) ([]*FileEntry, error) {
+	records := make(chan *FileEntry, 1000)
+	err := p.ParseRecords(records)
+	entries := make([]*FileEntry, 0)
+	for e := range records {
+		entries = append(entries, e)
+	}
+	return entries, err
+}
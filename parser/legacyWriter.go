@@ -0,0 +1,155 @@
+package parser
+
+import "os"
+import "bufio"
+import "io"
+import "fmt"
+import "strconv"
+import "strings"
+import "encoding/binary"
+
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// LegacyWriter writes traces in the legacy format read by LegacyParser: a
+// "filename\tsize[\ttype]" line per file followed by its chunk records and
+// the end of the chunk list.
+type LegacyWriter struct {
+	file   *os.File // nil if the writer doesn't own the output
+	output *bufio.Writer
+
+	files           int    // number of file entries written
+	open            bool   // the chunk list of the current file isn't terminated yet
+	remainingChunks uint32 // chunks of the current file still expected by WriteMessage
+}
+
+// NewLegacyWriter creates a buffered LegacyWriter on top of w. Closing the
+// LegacyWriter doesn't close w.
+func NewLegacyWriter(w io.Writer) *LegacyWriter {
+	return &LegacyWriter{output: bufio.NewWriterSize(w, 4*1024*1024)}
+}
+
+// CreateLegacyWriter creates or truncates the file at filepath and returns a
+// LegacyWriter for it.
+func CreateLegacyWriter(filepath string) (*LegacyWriter, error) {
+	f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	w := NewLegacyWriter(f)
+	w.file = f
+	return w, nil
+}
+
+// Files returns the number of file entries written so far.
+func (w *LegacyWriter) Files() int {
+	return w.files
+}
+
+// WriteFile terminates the previous file entry and writes the file line of
+// the next one. File.chunkCount is ignored; the entry ends with the next
+// WriteFile or Close.
+func (w *LegacyWriter) WriteFile(f *traceProto.File) error {
+	for _, field := range []string{f.GetFilename(), f.GetType()} {
+		if strings.ContainsAny(field, "\t\n") {
+			return fmt.Errorf("file entry %v: %q contains a tab or newline", w.files, field)
+		}
+	}
+	if err := w.endChunkList(); err != nil {
+		return err
+	}
+
+	line := f.GetFilename() + "\t" + strconv.FormatUint(f.GetFsize(), 10)
+	if f.GetType() != "" {
+		line += "\t" + f.GetType()
+	}
+	if _, err := w.output.WriteString(line + "\n"); err != nil {
+		return err
+	}
+	w.files++
+	w.open = true
+	return nil
+}
+
+// WriteChunk writes a chunk record of the current file entry. The fingerprint
+// must have 20 bytes.
+func (w *LegacyWriter) WriteChunk(c *traceProto.Chunk) error {
+	if !w.open {
+		return fmt.Errorf("chunk without file entry")
+	} else if len(c.Fp) != legacyFpSize {
+		return fmt.Errorf("file entry %v: fingerprint has %v bytes instead of %v", w.files-1, len(c.Fp), legacyFpSize)
+	}
+
+	var record [legacyRecordSize + 1]byte
+	record[0] = legacyRecordSize
+	binary.LittleEndian.PutUint32(record[1:], c.GetCsize())
+	copy(record[1+legacySizeLen:], c.Fp)
+	_, err := w.output.Write(record[:])
+	return err
+}
+
+// WriteEntry writes a whole file entry.
+func (w *LegacyWriter) WriteEntry(e *FileEntry) error {
+	if err := w.WriteFile(e.File); err != nil {
+		return err
+	}
+	for _, c := range e.Chunks {
+		if err := w.WriteChunk(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteMessage writes a marshalled fs-c message as produced by the parsers.
+// Whether it is a file or a chunk is derived from File.chunkCount of the
+// preceding file.
+func (w *LegacyWriter) WriteMessage(msg []byte) error {
+	if w.remainingChunks > 0 {
+		c := new(traceProto.Chunk)
+		if err := c.Unmarshal(msg); err != nil {
+			return fmt.Errorf("couldn't unmarshal chunk message of file entry %v: %v", w.files-1, err)
+		}
+		w.remainingChunks--
+		return w.WriteChunk(c)
+	}
+
+	f := new(traceProto.File)
+	if err := f.Unmarshal(msg); err != nil {
+		return fmt.Errorf("couldn't unmarshal file message %v: %v", w.files, err)
+	}
+	w.remainingChunks = f.GetChunkCount()
+	return w.WriteFile(f)
+}
+
+func (w *LegacyWriter) endChunkList() error {
+	if !w.open {
+		return nil
+	}
+	w.open = false
+	_, err := w.output.Write([]byte{legacyChunkListEnd, '\n'})
+	return err
+}
+
+// Flush writes all buffered data to the underlying writer. The chunk list of
+// the current file entry isn't terminated yet.
+func (w *LegacyWriter) Flush() error {
+	return w.output.Flush()
+}
+
+// Close terminates the last file entry, flushes the writer and closes the
+// output file if it was created by CreateLegacyWriter.
+func (w *LegacyWriter) Close() error {
+	err := w.endChunkList()
+	if ferr := w.output.Flush(); err == nil {
+		err = ferr
+	}
+	if w.file != nil {
+		if cerr := w.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil && w.remainingChunks > 0 {
+		err = fmt.Errorf("file entry %v is missing %v chunks", w.files-1, w.remainingChunks)
+	}
+	return err
+}
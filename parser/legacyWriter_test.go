@@ -0,0 +1,161 @@
+package parser
+
+import "testing"
+import "bytes"
+import "os"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+func legacyTestEntries() []*FileEntry {
+	entries := make([]*FileEntry, 0)
+	for i, chunkCount := range []int{3, 0, 1, 2} {
+		e := &FileEntry{File: &traceProto.File{Filename: proto.String("dir/file" + string(rune('A'+i))), Type: proto.String("")}}
+		if i%2 == 0 {
+			e.File.Type = proto.String("txt")
+		}
+		var fsize uint64
+		for j := 0; j < chunkCount; j++ {
+			c := &traceProto.Chunk{Fp: bytes.Repeat([]byte{byte(16*i + j)}, 20), Csize: proto.Uint32(uint32(1000*j + 0xabcd))}
+			fsize += uint64(c.GetCsize())
+			e.Chunks = append(e.Chunks, c)
+		}
+		e.File.Fsize = proto.Uint64(fsize)
+		e.File.ChunkCount = proto.Uint32(uint32(chunkCount))
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestLegacyWriterRoundTrip(t *testing.T) {
+	// parsing and writing reproduces the trace byte by byte
+	outchan := make(chan []byte, 100)
+	p, _ := NewLegacyParserFromReader("legacyTest", bytes.NewReader(legacyTestTrace()), outchan)
+	if err := p.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := NewLegacyWriter(&buf)
+	for m := range outchan {
+		if err := w.WriteMessage(m); err != nil {
+			t.Fatalf("Couldn't write message: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Couldn't close writer: %v", err)
+	} else if !bytes.Equal(buf.Bytes(), legacyTestTrace()) {
+		t.Fatalf("Wrong trace:\n%q\nexpected:\n%q", buf.Bytes(), legacyTestTrace())
+	} else if w.Files() != 1 {
+		t.Fatalf("Wrong number of files: %v", w.Files())
+	}
+}
+
+func TestLegacyWriterEntries(t *testing.T) {
+	entries := legacyTestEntries()
+	var buf bytes.Buffer
+	w := NewLegacyWriter(&buf)
+	for _, e := range entries {
+		if err := w.WriteEntry(e); err != nil {
+			t.Fatalf("Couldn't write entry: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Couldn't close writer: %v", err)
+	}
+
+	parsed, err := parseLegacy(t, buf.Bytes())
+	if err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	} else if len(parsed) != len(entries) {
+		t.Fatalf("Wrong number of entries: got %v, expected: %v", len(parsed), len(entries))
+	}
+	for i := range entries {
+		if !proto.Equal(parsed[i].File, entries[i].File) {
+			t.Fatalf("Wrong file %v: got %v, expected: %v", i, parsed[i].File, entries[i].File)
+		} else if len(parsed[i].Chunks) != len(entries[i].Chunks) {
+			t.Fatalf("Wrong number of chunks in file %v: %v", i, len(parsed[i].Chunks))
+		}
+		for j := range entries[i].Chunks {
+			if !proto.Equal(parsed[i].Chunks[j], entries[i].Chunks[j]) {
+				t.Fatalf("Wrong chunk %v of file %v: got %v, expected: %v", j, i, parsed[i].Chunks[j], entries[i].Chunks[j])
+			}
+		}
+	}
+}
+
+// fs-c trace -> legacy trace -> fs-c trace
+func TestLegacyWriterFromProto(t *testing.T) {
+	var protoBuf bytes.Buffer
+	tw := NewTraceWriter(&protoBuf)
+	for _, e := range legacyTestEntries() {
+		tw.WriteEntry(e)
+	}
+	tw.Close()
+
+	outchan := make(chan []byte, 100)
+	pp, _ := NewProtoParserFromReader("protoTest", bytes.NewReader(protoBuf.Bytes()), outchan)
+	if err := pp.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+	if err := writeLegacyTrace("legacyWriterTesting", outchan); err != nil {
+		t.Fatalf("Couldn't write legacy trace: %v", err)
+	}
+	defer os.Remove("legacyWriterTesting")
+
+	outchan = make(chan []byte, 100)
+	lp, err := NewLegacyParser("legacyWriterTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize LegacyParser: %v", err)
+	} else if err := lp.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+	var result bytes.Buffer
+	tw = NewTraceWriter(&result)
+	for m := range outchan {
+		tw.WriteMessage(m)
+	}
+	tw.Close()
+	if !bytes.Equal(result.Bytes(), protoBuf.Bytes()) {
+		t.Fatal("Round trip changed the fs-c trace")
+	}
+}
+
+func writeLegacyTrace(path string, messages <-chan []byte) error {
+	w, err := CreateLegacyWriter(path)
+	if err != nil {
+		return err
+	}
+	for m := range messages {
+		if err := w.WriteMessage(m); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func TestLegacyWriterErrors(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewLegacyWriter(&buf)
+	if err := w.WriteChunk(&traceProto.Chunk{Fp: make([]byte, 20)}); err == nil {
+		t.Fatal("Chunk without file was accepted")
+	}
+	if err := w.WriteFile(&traceProto.File{Filename: proto.String("a\tb")}); err == nil {
+		t.Fatal("Filename with tab was accepted")
+	}
+	if err := w.WriteFile(&traceProto.File{Filename: proto.String("a")}); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := w.WriteChunk(&traceProto.Chunk{Fp: make([]byte, 6)}); err == nil {
+		t.Fatal("Short fingerprint was accepted")
+	}
+
+	f := &traceProto.File{Filename: proto.String("b"), ChunkCount: proto.Uint32(1)}
+	msg, _ := f.Marshal()
+	if err := w.WriteMessage(msg); err != nil {
+		t.Fatalf("Couldn't write file message: %v", err)
+	} else if err := w.Close(); err == nil {
+		t.Fatal("Missing chunk wasn't reported")
+	}
+}
@@ -0,0 +1,279 @@
+package parser
+
+import "os"
+import "bufio"
+import "context"
+import "io"
+import "fmt"
+import "runtime"
+import "sync"
+
+// Record is a file entry delivered by ParseAll together with its trace.
+type Record struct {
+	Trace int    // index of the trace in the list given to ParseAll
+	Path  string // path of the trace
+	Entry *FileEntry
+}
+
+// PipelineOptions configures ParseAll.
+type PipelineOptions struct {
+	Format  string // format of all traces, FormatAuto if empty
+	Workers int    // number of traces or ranges parsed concurrently, runtime.NumCPU() if 0
+	Ordered bool   // deliver the records trace by trace in the given order instead of as parsed
+	Buffer  int    // records buffered per trace, ConstMaxFileEntries if 0
+	Ranges  int    // split each indexed, uncompressed proto trace into up to Ranges parts parsed concurrently, see ParseAll
+}
+
+// traceRange is the part of a trace parsed by a single worker.
+type traceRange struct {
+	trace int
+	split bool       // the trace is split, otherwise it is parsed as a whole
+	start IndexEntry // the first file entry of the range
+	end   int64      // offset after the range, 0 for the end of the trace
+}
+
+// ParseAll parses the traces at paths with up to PipelineOptions.Workers
+// concurrent parsers and sends all records to out. Closes out when all traces
+// are parsed. Returns the error of each trace; a failed trace contributes the
+// records parsed before the error.
+//
+// With PipelineOptions.Ordered the records of trace i are delivered before
+// those of trace i+1, as if the traces were parsed one after another.
+// Otherwise the records of different traces are interleaved, but the records
+// of each trace stay in order.
+//
+// With PipelineOptions.Ranges > 1 every uncompressed proto trace is split into
+// up to Ranges byte ranges of about the same size, which start at file
+// entries and are parsed concurrently. The file entry boundaries are taken
+// from the index of the trace (see IndexSuffix), so only indexed traces are
+// split. Unless the records are ordered, the records of a split trace are
+// interleaved as well. Traces that can't be split, e.g. because they have no
+// index or it doesn't fit to the trace, are parsed as a whole.
+func ParseAll(paths []string, options PipelineOptions, out chan<- *Record) []error {
+	return ParseAllContext(context.Background(), paths, options, out)
+}
+
+// ParseAllContext is ParseAll that stops when ctx is cancelled. The records
+// parsed after the cancellation are dropped, traces that weren't started yet
+// fail with ctx.Err().
+func ParseAllContext(ctx context.Context, paths []string, options PipelineOptions, out chan<- *Record) []error {
+	if options.Format == "" {
+		options.Format = FormatAuto
+	}
+	if options.Workers <= 0 {
+		options.Workers = runtime.NumCPU()
+	}
+	if options.Buffer <= 0 {
+		options.Buffer = ConstMaxFileEntries
+	}
+
+	ranges := splitTraces(paths, options)
+	rangeErrs := make([]error, len(ranges))
+	workers := make(chan bool, options.Workers)
+	var wg sync.WaitGroup
+
+	// In ordered mode every range gets its own channel, which is merged in
+	// order. Ranges are started in order, so when range i is merged all
+	// earlier ranges are done and range i holds or gets a worker.
+	var outputs []chan *Record
+	if options.Ordered {
+		outputs = make([]chan *Record, len(ranges))
+		for i := range ranges {
+			outputs[i] = make(chan *Record, options.Buffer)
+		}
+	}
+
+	wg.Add(len(ranges))
+	go func() {
+		for i, r := range ranges {
+			select {
+			case workers <- true:
+			case <-ctx.Done():
+				rangeErrs[i] = ctx.Err()
+				if options.Ordered {
+					close(outputs[i])
+				}
+				wg.Done()
+				continue
+			}
+			go func(i int, r traceRange) {
+				if options.Ordered {
+					rangeErrs[i] = parseTrace(ctx, r, paths[r.trace], options, outputs[i])
+					close(outputs[i])
+				} else {
+					rangeErrs[i] = parseTrace(ctx, r, paths[r.trace], options, out)
+				}
+				<-workers
+				wg.Done()
+			}(i, r)
+		}
+	}()
+
+	for i := range outputs {
+		for r := range outputs[i] {
+			select {
+			case out <- r:
+			case <-ctx.Done():
+			}
+		}
+	}
+	wg.Wait()
+	close(out)
+
+	// the error of a trace is the one of its first failed range
+	errs := make([]error, len(paths))
+	for i, r := range ranges {
+		if errs[r.trace] == nil {
+			errs[r.trace] = rangeErrs[i]
+		}
+	}
+	return errs
+}
+
+// parses a range of a trace and sends its records to out.
+func parseTrace(ctx context.Context, r traceRange, path string, options PipelineOptions, out chan<- *Record) error {
+	var p TraceParser
+	if r.split {
+		pp, err := NewProtoParser(path, nil)
+		if err != nil {
+			return err
+		}
+		if err := pp.SeekEntry(r.start); err != nil {
+			pp.Close()
+			return err
+		}
+		pp.SetEnd(r.end)
+		p = pp
+	} else {
+		var err error
+		if p, err = Open(options.Format, path, nil); err != nil {
+			return err
+		}
+	}
+
+	entries := make(chan *FileEntry, options.Buffer)
+	errChan := make(chan error, 1)
+	go func() { errChan <- p.ParseRecordsContext(ctx, entries) }()
+
+	// entries is drained after a cancellation until the parser gives up
+	for e := range entries {
+		select {
+		case out <- &Record{Trace: r.trace, Path: path, Entry: e}:
+		case <-ctx.Done():
+		}
+	}
+	return <-errChan
+}
+
+// splitTraces returns the ranges of all traces in order. The traces are split
+// concurrently.
+func splitTraces(paths []string, options PipelineOptions) []traceRange {
+	split := make([][]traceRange, len(paths))
+	workers := make(chan bool, options.Workers)
+	var wg sync.WaitGroup
+
+	wg.Add(len(paths))
+	for i, path := range paths {
+		workers <- true
+		go func(i int, path string) {
+			split[i] = splitTrace(i, path, options.Format, options.Ranges)
+			<-workers
+			wg.Done()
+		}(i, path)
+	}
+	wg.Wait()
+
+	ranges := make([]traceRange, 0, len(paths))
+	for _, s := range split {
+		ranges = append(ranges, s...)
+	}
+	return ranges
+}
+
+// splitTrace splits the trace at path into up to n ranges of about the same
+// size. Traces of other formats than proto, compressed traces and traces
+// without a fitting index aren't split.
+func splitTrace(trace int, path string, format string, n int) []traceRange {
+	whole := []traceRange{{trace: trace}}
+	if n <= 1 {
+		return whole
+	} else if format == FormatAuto {
+		if d, err := DetectFile(path); err != nil || d.Format != FormatProto {
+			return whole
+		}
+	} else if format != FormatProto {
+		return whole
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return whole
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return whole
+	}
+	br := bufio.NewReader(f)
+	if magic, _ := br.Peek(len(xzMagic)); compressed(magic) {
+		return whole
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return whole
+	}
+
+	targets := make([]int64, n-1)
+	for i := range targets {
+		targets[i] = info.Size() * int64(i+1) / int64(n)
+	}
+	starts, err := indexedBoundaries(path, f, info.Size(), targets)
+	if err != nil {
+		return whole
+	}
+
+	ranges := []traceRange{{trace: trace, split: true}}
+	for _, s := range starts {
+		ranges[len(ranges)-1].end = s.Offset
+		ranges = append(ranges, traceRange{trace: trace, split: true, start: s})
+	}
+	return ranges
+}
+
+// indexedBoundaries returns the first file entry at or after each target
+// offset according to the index of the trace at path, which is read from f.
+// Fails if there is no index or it doesn't fit to the trace, e.g. because the
+// trace was regenerated after indexing: each returned entry is checked to
+// start with a file message with the indexed chunk count.
+func indexedBoundaries(path string, f io.ReadSeeker, size int64, targets []int64) ([]IndexEntry, error) {
+	ix, err := LoadIndex(path + IndexSuffix)
+	if err != nil {
+		return nil, err
+	} else if n := len(ix.Entries); n == 0 || ix.Entries[n-1].Offset >= size {
+		return nil, os.ErrInvalid
+	}
+
+	starts := make([]IndexEntry, 0, len(targets))
+	for _, target := range targets {
+		e, ok := ix.LookupOffset(target)
+		if !ok {
+			break
+		} else if e.Offset > 0 && (len(starts) == 0 || e.Offset > starts[len(starts)-1].Offset) {
+			starts = append(starts, e)
+		}
+	}
+
+	p, err := NewProtoParserFromReader(path, f, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range starts {
+		if err := p.SeekEntry(e); err != nil {
+			return nil, err
+		}
+		if file, err := p.skipFileEntry(); err != nil {
+			return nil, fmt.Errorf("%v: index doesn't fit to the trace at file entry %v: %v", path, e.File, err)
+		} else if file.GetChunkCount() != e.ChunkCount {
+			return nil, fmt.Errorf("%v: index doesn't fit to the trace at file entry %v: %v instead of %v chunks", path, e.File, file.GetChunkCount(), e.ChunkCount)
+		}
+	}
+	return starts, nil
+}
@@ -0,0 +1,225 @@
+package parser
+
+import "testing"
+import "context"
+import "errors"
+import "fmt"
+import "path/filepath"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// writes n proto traces with trace+1 files of one chunk each to a temporary
+// directory
+func writePipelineTraces(t *testing.T, n int) []string {
+	dir := t.TempDir()
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("pipelineTesting%v", i))
+		entries := make([]*FileEntry, i+1)
+		for j := range entries {
+			entries[j] = &FileEntry{
+				File:   &traceProto.File{Filename: proto.String(fmt.Sprintf("%v/%v", i, j))},
+				Chunks: []*traceProto.Chunk{{Fp: []byte{byte(i), byte(j)}, Csize: proto.Uint32(1)}},
+			}
+		}
+		writeTestTrace(t, paths[i], entries, nil)
+	}
+	return paths
+}
+
+func collect(paths []string, options PipelineOptions) ([]*Record, []error) {
+	out := make(chan *Record)
+	errChan := make(chan []error, 1)
+	go func() { errChan <- ParseAll(paths, options, out) }()
+
+	records := make([]*Record, 0)
+	for r := range out {
+		records = append(records, r)
+	}
+	return records, <-errChan
+}
+
+func TestParseAllOrdered(t *testing.T) {
+	paths := writePipelineTraces(t, 8)
+
+	records, errs := collect(paths, PipelineOptions{Format: FormatProto, Workers: 3, Ordered: true, Buffer: 1})
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Error in trace %v: %v", i, err)
+		}
+	}
+	if len(records) != 36 {
+		t.Fatalf("Wrong number of records: got %v, expected: 36", len(records))
+	}
+
+	n := 0
+	for i := range paths {
+		for j := 0; j <= i; j++ {
+			r := records[n]
+			if r.Trace != i || r.Path != paths[i] || r.Entry.File.GetFilename() != fmt.Sprintf("%v/%v", i, j) {
+				t.Fatalf("Wrong record %v: %v %v %v", n, r.Trace, r.Path, r.Entry.File)
+			}
+			n++
+		}
+	}
+}
+
+func TestParseAllUnordered(t *testing.T) {
+	paths := writePipelineTraces(t, 8)
+
+	records, errs := collect(append(paths, "doesNotExist"), PipelineOptions{Workers: 4})
+	if len(errs) != 9 || errs[8] == nil {
+		t.Fatalf("Missing trace wasn't reported: %v", errs)
+	}
+	for i := range paths {
+		if errs[i] != nil {
+			t.Fatalf("Error in trace %v: %v", i, errs[i])
+		}
+	}
+
+	// the records of each trace are complete and in order
+	next := make([]int, len(paths))
+	for _, r := range records {
+		if name := fmt.Sprintf("%v/%v", r.Trace, next[r.Trace]); r.Entry.File.GetFilename() != name {
+			t.Fatalf("Wrong record of trace %v: got %v, expected: %v", r.Trace, r.Entry.File.GetFilename(), name)
+		}
+		next[r.Trace]++
+	}
+	for i := range next {
+		if next[i] != i+1 {
+			t.Fatalf("Trace %v has %v records instead of %v", i, next[i], i+1)
+		}
+	}
+}
+
+func TestParseAllFormats(t *testing.T) {
+	testdata := protoParseTestInit(t)
+	Init()
+
+	paths := []string{"ubcTesting", testdata["FileWith4Chunks"], "ubcTesting"}
+	records, errs := collect(paths, PipelineOptions{Ordered: true})
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Error in trace %v: %v", i, err)
+		}
+	}
+
+	counts := make([]int, len(paths))
+	for _, r := range records {
+		counts[r.Trace]++
+	}
+	if counts[0] == 0 || counts[0] != counts[2] || counts[1] != 1 {
+		t.Fatalf("Wrong number of records per trace: %v", counts)
+	}
+}
+
+func TestParseAllEmpty(t *testing.T) {
+	if records, errs := collect(nil, PipelineOptions{}); len(records) != 0 || len(errs) != 0 {
+		t.Fatalf("Wrong result: %v %v", records, errs)
+	}
+}
+
+func TestParseAllCancel(t *testing.T) {
+	paths := writePipelineTraces(t, 8)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan *Record)
+	errChan := make(chan []error, 1)
+	go func() {
+		errChan <- ParseAllContext(ctx, paths, PipelineOptions{Format: FormatProto, Workers: 1, Ordered: true, Buffer: 1}, out)
+	}()
+
+	<-out
+	cancel()
+	for _ = range out {
+	}
+
+	errs := <-errChan
+	if !errors.Is(errs[len(errs)-1], context.Canceled) {
+		t.Fatalf("Last trace wasn't cancelled: %v", errs[len(errs)-1])
+	}
+}
+
+func TestSplitTrace(t *testing.T) {
+	trace, _ := writeIndexedTrace(t, 100)
+
+	check := func(ranges []traceRange) {
+		if len(ranges) != 4 {
+			t.Fatalf("Wrong number of ranges: %+v", ranges)
+		}
+		for i, r := range ranges {
+			if !r.split {
+				t.Fatalf("Range %v isn't split", i)
+			} else if i > 0 && (r.start.Offset != ranges[i-1].end || r.start.File <= ranges[i-1].start.File) {
+				t.Fatalf("Range %v doesn't follow range %v: %+v", i, i-1, ranges)
+			}
+		}
+		if ranges[0].start.Offset != 0 || ranges[3].end != 0 {
+			t.Fatalf("Ranges don't cover the trace: %+v", ranges)
+		}
+	}
+
+	// without an index the trace isn't split
+	if r := splitTrace(0, trace, FormatAuto, 4); len(r) != 1 || r[0].split {
+		t.Fatalf("Trace without index was split: %+v", r)
+	}
+
+	if _, err := IndexProtoFile(trace, trace+IndexSuffix, 1); err != nil {
+		t.Fatalf("Couldn't index trace: %v", err)
+	}
+	index, err := LoadIndex(trace + IndexSuffix)
+	if err != nil {
+		t.Fatalf("Couldn't load index: %v", err)
+	}
+	indexed := splitTrace(0, trace, FormatAuto, 4)
+	check(indexed)
+	for i, r := range indexed[1:] {
+		if e, _ := index.LookupOffset(r.start.Offset); e != r.start {
+			t.Fatalf("Range %v doesn't start at an indexed entry: %+v", i+1, r.start)
+		}
+	}
+
+	if r := splitTrace(0, trace, FormatProto, 1); len(r) != 1 || r[0].split {
+		t.Fatalf("Trace was split into a single range: %+v", r)
+	} else if r := splitTrace(0, trace, FormatUBC, 4); len(r) != 1 || r[0].split {
+		t.Fatalf("Trace of another format was split: %+v", r)
+	}
+
+	// an index of another trace doesn't fit, e.g. after regenerating it
+	entries := testEntries(100)
+	entries[10].Chunks = append(entries[10].Chunks, entries[11].Chunks...)
+	writeTestTrace(t, trace, entries, nil)
+	if r := splitTrace(0, trace, FormatProto, 4); len(r) != 1 || r[0].split {
+		t.Fatalf("Trace with a stale index was split: %+v", r)
+	}
+}
+
+func TestParseAllRanges(t *testing.T) {
+	trace, _ := writeIndexedTrace(t, 100)
+	if _, err := IndexProtoFile(trace, trace+IndexSuffix, 7); err != nil {
+		t.Fatalf("Couldn't index trace: %v", err)
+	}
+
+	for _, ordered := range []bool{true, false} {
+		records, errs := collect([]string{trace}, PipelineOptions{Format: FormatProto, Workers: 3, Ordered: ordered, Ranges: 5, Buffer: 1})
+		if errs[0] != nil {
+			t.Fatalf("Error during parsing: %v", errs[0])
+		} else if len(records) != 100 {
+			t.Fatalf("Wrong number of records: got %v, expected: 100", len(records))
+		}
+
+		seen := make(map[string]bool)
+		for i, r := range records {
+			name := r.Entry.File.GetFilename()
+			if ordered && name != fmt.Sprintf("file %v", i) {
+				t.Fatalf("Record %v is out of order: %v", i, name)
+			} else if seen[name] {
+				t.Fatalf("Record %v was delivered twice", name)
+			} else if len(r.Entry.Chunks) != i%3 && ordered {
+				t.Fatalf("Record %v has %v chunks", name, len(r.Entry.Chunks))
+			}
+			seen[name] = true
+		}
+	}
+}
@@ -2,45 +2,284 @@ package parser
 
 import "os"
 import "bufio"
+import "context"
 import "io"
+import "fmt"
 import "github.com/jkaiser/dedup_tools/traceProto"
 
 import "github.com/gogo/protobuf/proto"
-import log "github.com/cihub/seelog"
 
 type ProtoParser struct {
-	filename   string
-	file       *bufio.Reader
-	rawFile    *os.File
-	outputChan chan<- []byte
+	filename string
+	file     *bufio.Reader
+	counter  *countingReader
+	seeker   io.ReadSeeker // the undecompressed input if it is seekable
+	end      int64         // offset at which the parsing stops, 0 for the end of the trace
+	emitter
 
 	msgBuffer *proto.Buffer
+	entry     *FileEntry        // the current file entry in record mode
+	entryPool <-chan *FileEntry // returned file entries for reuse in record mode
+	fileMsg   traceProto.File   // the current file message in message mode
+	scratch   []byte            // buffer of messages larger than the read buffer in record mode
+
+	record int   // number of the current file entry
+	err    error // the error that stopped the parsing
 }
 
-func NewProtoParser(filepath string, outChan chan<- []byte) *ProtoParser {
+func NewProtoParser(filepath string, outChan chan<- []byte) (*ProtoParser, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	parser, err := NewProtoParserFromReader(filepath, f, outChan)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	parser.own(f)
+	return parser, nil
+}
+
+// NewProtoParserFromReader creates a parser that reads the trace from r. The
+// name is used in error messages only.
+func NewProtoParserFromReader(name string, r io.Reader, outChan chan<- []byte) (*ProtoParser, error) {
 	parser := new(ProtoParser)
-	parser.filename = filepath
+	parser.filename = name
 	parser.outputChan = outChan
 	parser.msgBuffer = proto.NewBuffer(nil)
+	if s, ok := r.(io.ReadSeeker); ok {
+		parser.seeker = s
+	}
 
-	if f, err := os.Open(filepath); err != nil {
-		log.Error("Couldn't open file to parse: ", err)
-		return nil
+	if r, err := decompress(r); err != nil {
+		return nil, err
 	} else {
-		parser.file = bufio.NewReaderSize(f, 4*1024*1024)
-		parser.rawFile = f
-		return parser
+		parser.counter = &countingReader{r: r}
+		parser.file = bufio.NewReaderSize(parser.counter, 4*1024*1024)
+		return parser, nil
 	}
 }
 
-// Parses the whole file
-func (p *ProtoParser) ParseFile() {
-	filecount := 0
-	for p.parseFileEntry() {
-		filecount++
+// Parses the whole file. Returns a *ParseError if the trace is malformed.
+func (p *ProtoParser) ParseFile() error {
+	return p.ParseFileContext(context.Background())
+}
+
+// ParseFileContext parses the whole file until ctx is cancelled. The returned
+// *ParseError wraps ctx.Err() if the parsing was cancelled.
+func (p *ProtoParser) ParseFileContext(ctx context.Context) error {
+	p.start(ctx, nil)
+	p.parse()
+	p.finish()
+	return p.err
+}
+
+// Parses the whole file and sends the decoded file entries to out instead of
+// the raw messages to the output channel. Closes out when finished.
+func (p *ProtoParser) ParseRecords(out chan<- *FileEntry) error {
+	return p.ParseRecordsContext(context.Background(), out)
+}
+
+// ParseRecordsContext is ParseRecords that stops when ctx is cancelled.
+func (p *ProtoParser) ParseRecordsContext(ctx context.Context, out chan<- *FileEntry) error {
+	p.start(ctx, out)
+	p.parse()
+	p.finish()
+	return p.err
+}
+
+func (p *ProtoParser) parse() {
+	for {
+		if err := p.cancelled(); err != nil {
+			p.fail(p.offset(), err)
+			return
+		}
+		if p.end > 0 && p.offset() >= p.end {
+			return
+		}
+		if !p.parseFileEntry() {
+			return
+		}
+		p.record++
 	}
-	//log.Info("Filecount in ParseFile() after finish ", filecount)
-	close(p.outputChan)
+}
+
+// SetEntryPool makes the parser reuse the FileEntry records (including their
+// chunks) it receives from pool in record mode. An entry must not be touched
+// by the consumer after it was returned to the pool.
+func (p *ProtoParser) SetEntryPool(pool <-chan *FileEntry) {
+	p.entryPool = pool
+}
+
+// SeekEntry makes the parser start at the file entry of e. Only uncompressed
+// traces read from a file or another io.ReadSeeker can be seeked, and only
+// before the parsing starts.
+func (p *ProtoParser) SeekEntry(e IndexEntry) error {
+	if p.seeker == nil {
+		return fmt.Errorf("%v: trace isn't seekable", p.filename)
+	}
+
+	magic := make([]byte, len(xzMagic))
+	if _, err := p.seeker.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.ReadFull(p.seeker, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	} else if compressed(magic[:n]) {
+		return fmt.Errorf("%v: compressed traces can't be seeked", p.filename)
+	}
+
+	if _, err := p.seeker.Seek(e.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	p.counter = &countingReader{r: p.seeker, n: e.Offset}
+	p.file.Reset(p.counter)
+	p.record = e.File
+	return nil
+}
+
+// SetEnd makes the parser stop at the first file entry at or after offset.
+// Together with SeekEntry it parses a range of the trace.
+func (p *ProtoParser) SetEnd(offset int64) {
+	p.end = offset
+}
+
+// SeekFile makes the parser start at file entry n. It seeks to the closest
+// entry of ix before n and skips the remaining file entries.
+func (p *ProtoParser) SeekFile(ix *Index, n int) error {
+	e, _ := ix.Lookup(n)
+	if err := p.SeekEntry(e); err != nil {
+		return err
+	}
+	for p.record < n {
+		start := p.offset()
+		if _, err := p.skipFileEntry(); err == io.EOF {
+			return fmt.Errorf("%v: trace has only %v file entries", p.filename, p.record)
+		} else if err != nil {
+			return &ParseError{Filename: p.filename, Offset: start, Record: p.record, Err: err}
+		}
+		p.record++
+	}
+	return nil
+}
+
+// SeekOffset makes the parser start at the first file entry of ix at or after
+// offset.
+func (p *ProtoParser) SeekOffset(ix *Index, offset int64) error {
+	e, ok := ix.LookupOffset(offset)
+	if !ok {
+		return fmt.Errorf("%v: no indexed file entry at or after offset %v", p.filename, offset)
+	}
+	return p.SeekEntry(e)
+}
+
+// skipFileEntry reads the next file message and skips its chunks without
+// decoding them. Returns io.EOF only at the end of the trace.
+func (p *ProtoParser) skipFileEntry() (*traceProto.File, error) {
+	size, err := p.readNextVarint()
+	if err != nil {
+		if err != io.EOF {
+			err = fmt.Errorf("couldn't read size of FileMsg: %v", err)
+		}
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(p.file, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("couldn't read FileMsg of size %v: %v", size, err)
+	}
+	f := new(traceProto.File)
+	if err := f.Unmarshal(buf); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal FileMsg of size %v: %v", size, err)
+	}
+
+	n := f.GetChunkCount()
+	for i := uint32(0); i < n; i++ {
+		if size, err = p.readNextVarint(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("couldn't read size of ChunkMsg %v of %v: %v", i, n, err)
+		}
+		if _, err := p.file.Discard(int(size)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("couldn't skip ChunkMsg %v of %v: %v", i, n, err)
+		}
+	}
+	return f, nil
+}
+
+// newEntry returns a cleared FileEntry, taken from the pool if possible.
+func (p *ProtoParser) newEntry() *FileEntry {
+	select {
+	case e := <-p.entryPool:
+		e.File.Reset()
+		e.Chunks = e.Chunks[:0]
+		return e
+	default:
+		return &FileEntry{File: new(traceProto.File)}
+	}
+}
+
+// nextChunk appends a chunk to the current entry and returns it. The chunk
+// may still hold the values of a former use, see unmarshalChunk.
+func (p *ProtoParser) nextChunk() *traceProto.Chunk {
+	e := p.entry
+	if len(e.Chunks) < cap(e.Chunks) {
+		e.Chunks = e.Chunks[:len(e.Chunks)+1]
+		if c := e.Chunks[len(e.Chunks)-1]; c != nil {
+			return c
+		}
+	} else {
+		e.Chunks = append(e.Chunks, nil)
+	}
+	c := new(traceProto.Chunk)
+	e.Chunks[len(e.Chunks)-1] = c
+	return c
+}
+
+// offset returns the number of bytes of the trace consumed so far.
+func (p *ProtoParser) offset() int64 {
+	return p.counter.n - int64(p.file.Buffered())
+}
+
+func (p *ProtoParser) fail(offset int64, err error) bool {
+	p.err = &ParseError{Filename: p.filename, Offset: offset, Record: p.record, Err: err}
+	return false
+}
+
+// readMsg reads the next message of the given size. In message mode the
+// message is read into a buffer of its own.
+// In record mode it is only valid until the next read, as it refers to the
+// read buffer if it fits.
+func (p *ProtoParser) readMsg(size uint64) ([]byte, error) {
+	if p.recordChan == nil {
+		buf := make([]byte, size)
+		n, err := io.ReadFull(p.file, buf)
+		return buf[:n], err
+	}
+
+	if size <= uint64(p.file.Size()) {
+		buf, err := p.file.Peek(int(size))
+		if err == io.EOF && len(buf) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		p.file.Discard(len(buf))
+		return buf, err
+	}
+
+	if uint64(cap(p.scratch)) < size {
+		p.scratch = make([]byte, size)
+	}
+	n, err := io.ReadFull(p.file, p.scratch[:size])
+	return p.scratch[:n], err
 }
 
 func (p *ProtoParser) parseFileEntry() bool {
@@ -49,29 +288,45 @@ func (p *ProtoParser) parseFileEntry() bool {
 	var err error
 
 	// varint
-	if msgSize, err = p.readNextVarint(); err != nil {
+	start := p.offset()
+	if msgSize, err = p.readNextVarint(); err == io.EOF {
 		return false
+	} else if err != nil {
+		return p.fail(start, fmt.Errorf("couldn't read size of FileMsg: %v", err))
 	}
-	//log.Info("MsgSize: the first VarInt: ", msgSize)
-	buf := make([]byte, msgSize)
-	if n, err := io.ReadFull(p.file, buf); err != nil {
-		pos, _ := p.rawFile.Seek(0, 1)
-		log.Errorf("Could not read next FileMsg of size %v, only read %v bytes. pos: %v, err: %v", msgSize, n, pos, err)
-		return false
+	buf, err := p.readMsg(msgSize)
+	if err != nil {
+		return p.fail(start, fmt.Errorf("couldn't read FileMsg of size %v, only read %v bytes: %v", msgSize, len(buf), err))
 	}
 
-	p.outputChan <- buf
+	var f *traceProto.File
+	if p.recordChan != nil {
+		p.entry = p.newEntry()
+		f = p.entry.File
+	} else {
+		f = &p.fileMsg
+		f.Reset()
+	}
+	if err := f.Unmarshal(buf); err != nil {
+		return p.fail(start, fmt.Errorf("couldn't unmarshal FileMsg of size %v: %v", len(buf), err))
+	}
 
-	f := new(traceProto.File)
-	if err := proto.Unmarshal(buf, f); err != nil {
-		log.Errorf("ProtoParser: Could not unmarshal next FileMsg of size %v: %v", len(buf), err)
-		return false
+	// the buffer belongs to the consumer once it is sent
+	if p.recordChan == nil {
+		if err := p.send(buf); err != nil {
+			return p.fail(start, err)
+		}
 	}
 
 	if !p.parseNChunks(f.GetChunkCount()) {
-		log.Error("ProtoParser: Error during parsing chunks")
 		return false
 	}
+	if p.recordChan != nil {
+		if err := p.sendRecord(p.entry); err != nil {
+			return p.fail(start, err)
+		}
+		p.entry = nil
+	}
 	return true
 }
 
@@ -84,36 +339,100 @@ func (p *ProtoParser) parseNChunks(n uint32) bool {
 	for i := uint32(0); i < n; i++ {
 
 		// varint
+		start := p.offset()
 		if msgSize, err = p.readNextVarint(); err != nil {
-			log.Error("Couldn't read next chunkMsg size: ", err)
-			return false
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return p.fail(start, fmt.Errorf("couldn't read size of ChunkMsg %v of %v: %v", i, n, err))
 		}
 
 		// msg
-		buf := make([]byte, msgSize)
-		if _, err := io.ReadFull(p.file, buf); err != nil {
-			log.Error("Could not read next ChunkMsg: ", err)
-			return false
+		buf, err := p.readMsg(msgSize)
+		if err != nil {
+			return p.fail(start, fmt.Errorf("couldn't read ChunkMsg %v of %v: %v", i, n, err))
 		}
 
-		p.outputChan <- buf
+		if p.recordChan == nil {
+			if err := p.send(buf); err != nil {
+				return p.fail(start, err)
+			}
+			continue
+		}
+		if err := unmarshalChunk(p.nextChunk(), buf); err != nil {
+			return p.fail(start, fmt.Errorf("couldn't unmarshal ChunkMsg %v of %v: %v", i, n, err))
+		}
 	}
 
 	return true
 }
 
+// unmarshalChunk decodes buf into c like c.Unmarshal, but reuses the
+// fingerprint buffer and the storage of the optional fields of a former use of
+// c. Malformed messages and unknown fields are left to c.Unmarshal.
+func unmarshalChunk(c *traceProto.Chunk, buf []byte) error {
+	fp, csize, hash, zero := c.Fp[:0], c.Csize, c.ChunkHash, c.Zero
+	c.Reset()
+	for i := 0; i < len(buf); {
+		key, n := proto.DecodeVarint(buf[i:])
+		v, m := proto.DecodeVarint(buf[i+n:])
+		if n == 0 || m == 0 {
+			c.Reset()
+			return c.Unmarshal(buf)
+		}
+		i += n + m
+
+		switch {
+		case key == 2<<3|proto.WireBytes && v <= uint64(len(buf)-i):
+			fp = append(fp, buf[i:i+int(v)]...)
+			c.Fp = fp
+			i += int(v)
+		case key == 3<<3|proto.WireVarint:
+			if csize == nil {
+				csize = new(uint32)
+			}
+			*csize = uint32(v)
+			c.Csize = csize
+		case key == 4<<3|proto.WireVarint:
+			if hash == nil {
+				hash = new(int64)
+			}
+			*hash = int64(v)
+			c.ChunkHash = hash
+		case key == 5<<3|proto.WireVarint:
+			if zero == nil {
+				zero = new(bool)
+			}
+			*zero = v != 0
+			c.Zero = zero
+		default:
+			c.Reset()
+			return c.Unmarshal(buf)
+		}
+	}
+	return nil
+}
+
+// The maximum length of a varint.
+const maxVarintLen = 10
+
+// Reads the next varint. Returns io.EOF only if the trace ends before the
+// first byte of the varint.
 func (p *ProtoParser) readNextVarint() (uint64, error) {
 
-	buf := make([]byte, 0, 10)
-	for {
-		if b, err := p.file.ReadByte(); err != nil {
-			return 0, err
-		} else {
-			buf = append(buf, b)
-			n, consumed := proto.DecodeVarint(buf)
-			if (n != 0) || (consumed != 0) {
-				return n, err
+	var x uint64
+	for i := 0; i < maxVarintLen; i++ {
+		b, err := p.file.ReadByte()
+		if err != nil {
+			if err == io.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
 			}
+			return 0, err
+		}
+		x |= uint64(b&0x7f) << (7 * uint(i))
+		if b < 0x80 {
+			return x, nil
 		}
 	}
+	return 0, fmt.Errorf("varint exceeds %v bytes", maxVarintLen)
 }
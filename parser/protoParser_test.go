@@ -3,6 +3,7 @@ package parser
 import "testing"
 
 import "os"
+import "bytes"
 import "io/ioutil"
 
 //import "code.google.com/p/goprotobuf/proto"
@@ -109,7 +110,10 @@ func protoParseTestInit(t *testing.T) map[string]string {
 func TestParseEmptyFile(t *testing.T) {
 	testdata := protoParseTestInit(t)
 	messageChan := make(chan []byte, 1000)
-	protoParser := NewProtoParser(testdata["emptyFile"], messageChan)
+	protoParser, err := NewProtoParser(testdata["emptyFile"], messageChan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize ProtoParser: %v", err)
+	}
 
 	if !protoParser.parseFileEntry() {
 		t.Fatal("Error during empty file parsing.")
@@ -144,9 +148,14 @@ func TestParseEmptyFile(t *testing.T) {
 
 	// now on 'ParseFile'
 	messageChan = make(chan []byte, 1000)
-	protoParser = NewProtoParser(testdata["emptyFile"], messageChan)
+	protoParser, err = NewProtoParser(testdata["emptyFile"], messageChan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize ProtoParser: %v", err)
+	}
 
-	protoParser.ParseFile()
+	if err := protoParser.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
 
 	buf, ok = <-messageChan
 	if !ok {
@@ -187,10 +196,15 @@ func TestParseFilledFile2(t *testing.T) {
 	testfile.Close()
 
 	messageChan := make(chan []byte, 1000)
-	protoParser := NewProtoParser("protoTesting2Files", messageChan)
+	protoParser, err := NewProtoParser("protoTesting2Files", messageChan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize ProtoParser: %v", err)
+	}
 
 	// now on 'ParseFile'
-	protoParser.ParseFile()
+	if err := protoParser.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
 
 	buf, ok := <-messageChan
 	if !ok {
@@ -273,10 +287,15 @@ func TestParseFilledFile(t *testing.T) {
 	testdata := protoParseTestInit(t)
 
 	messageChan := make(chan []byte, 1000)
-	protoParser := NewProtoParser(testdata["FileWith4Chunks"], messageChan)
+	protoParser, err := NewProtoParser(testdata["FileWith4Chunks"], messageChan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize ProtoParser: %v", err)
+	}
 
 	// now on 'ParseFile'
-	protoParser.ParseFile()
+	if err := protoParser.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
 
 	buf, ok := <-messageChan
 	if !ok {
@@ -321,7 +340,10 @@ func TestParseChunks(t *testing.T) {
 
 	// 4 out of 4 chunks
 	messageChan := make(chan []byte, 1000)
-	protoParser := NewProtoParser(testdata["4chunks"], messageChan)
+	protoParser, err := NewProtoParser(testdata["4chunks"], messageChan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize ProtoParser: %v", err)
+	}
 
 	if !protoParser.parseNChunks(4) {
 		t.Fatal("Error while parsing 4 chunks")
@@ -342,3 +364,237 @@ func TestParseChunks(t *testing.T) {
 		}
 	}
 }
+
+func TestParseTruncatedFile(t *testing.T) {
+	testdata := protoParseTestInit(t)
+	buf, err := ioutil.ReadFile(testdata["FileWith4Chunks"])
+	if err != nil {
+		t.Fatalf("input file not available")
+	}
+	if _, err := os.Stat("protoTestingTruncated"); err == nil {
+		os.Remove("protoTestingTruncated")
+	}
+	// cut the last chunk in half
+	ioutil.WriteFile("protoTestingTruncated", buf[:len(buf)-7], 0666)
+	defer os.Remove("protoTestingTruncated")
+
+	messageChan := make(chan []byte, 1000)
+	protoParser, err := NewProtoParser("protoTestingTruncated", messageChan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize ProtoParser: %v", err)
+	}
+
+	err = protoParser.ParseFile()
+	if err == nil {
+		t.Fatal("Parsing a truncated trace returned no error")
+	}
+	perr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Wrong error type: got %T", err)
+	} else if perr.Filename != "protoTestingTruncated" {
+		t.Fatalf("Wrong filename in error: got %v", perr.Filename)
+	} else if perr.Record != 0 {
+		t.Fatalf("Wrong record in error: got %v", perr.Record)
+	} else if perr.Offset != int64(len(buf)-15) {
+		t.Fatalf("Wrong offset in error: got %v, expected: %v", perr.Offset, len(buf)-15)
+	}
+
+	// file msg and 3 complete chunks
+	if len(messageChan) != 4 {
+		t.Fatalf("Wrong number of messages: got %v, expected: 4", len(messageChan))
+	}
+}
+
+func TestNewProtoParserMissingFile(t *testing.T) {
+	messageChan := make(chan []byte, 1000)
+	if p, err := NewProtoParser("doesNotExist", messageChan); err == nil {
+		t.Fatalf("NewProtoParser returned parser %v for missing file", p)
+	}
+}
+
+func TestParseRecords(t *testing.T) {
+	testdata := protoParseTestInit(t)
+	buf, err := ioutil.ReadFile(testdata["FileWith4Chunks"])
+	if err != nil {
+		t.Fatalf("input file not available")
+	}
+	protoParser, err := NewProtoParserFromReader("in-memory", bytes.NewReader(bytes.Repeat(buf, 2)), nil)
+	if err != nil {
+		t.Fatalf("Couldn't initialize ProtoParser: %v", err)
+	}
+
+	recordChan := make(chan *FileEntry, 10)
+	if err := protoParser.ParseRecords(recordChan); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+
+	entries := make([]*FileEntry, 0)
+	for e := range recordChan {
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Wrong number of file entries: got %v, expected: 2", len(entries))
+	}
+
+	for _, e := range entries {
+		if e.File.GetFilename() != "filename A" {
+			t.Fatalf("Wrong filename: got %v", e.File.GetFilename())
+		} else if e.File.GetChunkCount() != 4 {
+			t.Fatalf("Wrong chunkCount: got %v", e.File.GetChunkCount())
+		} else if len(e.Chunks) != 4 {
+			t.Fatalf("Wrong number of chunks: got %v", len(e.Chunks))
+		}
+
+		for i, chunk := range e.Chunks {
+			if chunk.GetFp()[0] != byte(i) {
+				t.Fatalf("Chunk %v has wrong fp, got: %x", i, chunk.GetFp())
+			} else if chunk.GetCsize() != uint32(i) {
+				t.Fatalf("Chunk %v has wrong size, got: %v", i, chunk.GetCsize())
+			}
+		}
+	}
+}
+
+func TestParseFromReader(t *testing.T) {
+	testdata := protoParseTestInit(t)
+	buf, err := ioutil.ReadFile(testdata["FileWith4Chunks"])
+	if err != nil {
+		t.Fatalf("input file not available")
+	}
+
+	messageChan := make(chan []byte, 1000)
+	protoParser, err := NewProtoParserFromReader("in-memory", bytes.NewReader(buf), messageChan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize ProtoParser: %v", err)
+	}
+	if err := protoParser.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+	if len(messageChan) != 5 {
+		t.Fatalf("Wrong number of messages: got %v, expected: 5", len(messageChan))
+	}
+
+	// errors name the reader
+	messageChan = make(chan []byte, 1000)
+	protoParser, _ = NewProtoParserFromReader("in-memory", bytes.NewReader(buf[:len(buf)-1]), messageChan)
+	if err := protoParser.ParseFile(); err == nil {
+		t.Fatal("Parsing a truncated trace returned no error")
+	} else if perr, ok := err.(*ParseError); !ok || perr.Filename != "in-memory" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+// builds an in-memory trace of files entries with chunks chunks each
+func memoryTrace(files, chunks int, filename string) []byte {
+	var buf bytes.Buffer
+	w := NewTraceWriter(&buf)
+	for i := 0; i < files; i++ {
+		e := &FileEntry{File: &traceProto.File{Filename: proto.String(filename), Fsize: proto.Uint64(uint64(chunks) * 8192)}}
+		for j := 0; j < chunks; j++ {
+			fp := make([]byte, 20)
+			fp[0], fp[1] = byte(i), byte(j)
+			e.Chunks = append(e.Chunks, &traceProto.Chunk{Fp: fp, Csize: proto.Uint32(8192)})
+		}
+		w.WriteEntry(e)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestUnmarshalChunkReuse(t *testing.T) {
+	unknown := &traceProto.Chunk{Fp: []byte{7}, XXX_unrecognized: []byte{6<<3 | proto.WireVarint, 1}}
+	chunks := []*traceProto.Chunk{
+		{Fp: []byte{1, 2, 3}, Csize: proto.Uint32(8192)},
+		{Fp: []byte{4}, Csize: proto.Uint32(0), ChunkHash: proto.Int64(-5), Zero: proto.Bool(true)},
+		{Fp: []byte{5, 6}},
+		unknown,
+		{Fp: []byte{8, 9}, Csize: proto.Uint32(42), Zero: proto.Bool(false)},
+	}
+
+	c := new(traceProto.Chunk)
+	var csize *uint32
+	for i, expected := range chunks {
+		buf, err := proto.Marshal(expected)
+		if err != nil {
+			t.Fatalf("Couldn't marshal chunk %v: %v", i, err)
+		}
+		if err := unmarshalChunk(c, buf); err != nil {
+			t.Fatalf("Couldn't unmarshal chunk %v: %v", i, err)
+		} else if !proto.Equal(c, expected) {
+			t.Fatalf("Chunk %v: got %v, expected: %v", i, c, expected)
+		}
+		if i == 0 {
+			csize = c.Csize
+		} else if i == 1 && c.Csize != csize {
+			t.Fatal("Chunk size storage wasn't reused")
+		}
+	}
+
+	if err := unmarshalChunk(c, []byte{2<<3 | proto.WireBytes, 5, 1}); err == nil {
+		t.Fatal("Truncated chunk message wasn't detected")
+	}
+}
+
+func TestParseRecordsLargeMessage(t *testing.T) {
+	// the file message is larger than the read buffer
+	filename := string(bytes.Repeat([]byte("x"), 5*1024*1024))
+	trace := memoryTrace(2, 3, filename)
+
+	recordChan := make(chan *FileEntry, 10)
+	p, _ := NewProtoParserFromReader("in-memory", bytes.NewReader(trace), nil)
+	if err := p.ParseRecords(recordChan); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+
+	cnt := 0
+	for e := range recordChan {
+		if e.File.GetFilename() != filename {
+			t.Fatalf("Entry %v has wrong filename of length %v", cnt, len(e.File.GetFilename()))
+		} else if len(e.Chunks) != 3 || e.Chunks[2].GetFp()[1] != 2 {
+			t.Fatalf("Entry %v has wrong chunks: %v", cnt, e.Chunks)
+		}
+		cnt++
+	}
+	if cnt != 2 {
+		t.Fatalf("Wrong number of file entries: got %v, expected: 2", cnt)
+	}
+}
+
+const benchFiles, benchChunks = 1000, 100
+
+// parses an in-memory trace b.N times and reports the throughput in chunks/s
+func benchmarkParse(b *testing.B, records, pooled bool) {
+	trace := memoryTrace(benchFiles, benchChunks, "some/dir/file.ext")
+	b.SetBytes(int64(len(trace)))
+	b.ReportAllocs()
+	pool := make(chan *FileEntry, 2*ConstMaxFileEntries) // shared by the runs
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if records {
+			recordChan := make(chan *FileEntry, ConstMaxFileEntries)
+			p, _ := NewProtoParserFromReader("in-memory", bytes.NewReader(trace), nil)
+			if pooled {
+				p.SetEntryPool(pool)
+			}
+			go p.ParseRecords(recordChan)
+			for e := range recordChan {
+				select {
+				case pool <- e:
+				default:
+				}
+			}
+		} else {
+			messageChan := make(chan []byte, ConstMaxFileEntries)
+			p, _ := NewProtoParserFromReader("in-memory", bytes.NewReader(trace), messageChan)
+			go p.ParseFile()
+			for range messageChan {
+			}
+		}
+	}
+	b.ReportMetric(float64(benchFiles*benchChunks*b.N)/b.Elapsed().Seconds(), "chunks/s")
+}
+
+func BenchmarkParseMessages(b *testing.B)      { benchmarkParse(b, false, false) }
+func BenchmarkParseRecords(b *testing.B)       { benchmarkParse(b, true, false) }
+func BenchmarkParseRecordsPooled(b *testing.B) { benchmarkParse(b, true, true) }
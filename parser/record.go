@@ -0,0 +1,132 @@
+package parser
+
+import "context"
+import "fmt"
+import "io"
+
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// FileEntry is a decoded file entry of a trace: the file metadata followed by
+// its chunks. File.ChunkCount always matches len(Chunks).
+type FileEntry struct {
+	File   *traceProto.File
+	Chunks []*traceProto.Chunk
+}
+
+// emitter hands parsed file entries to the consumer. If a record channel is
+// set, the entries are sent as FileEntry records. Otherwise the file and its
+// chunks are marshalled and sent one by one to the output channel.
+//
+// The emitter also holds the state of a parser run: the context that cancels
+// it and the trace file that is closed when the run ends.
+type emitter struct {
+	outputChan chan<- []byte
+	recordChan chan<- *FileEntry
+	ctx        context.Context
+	rawFile    io.Closer // nil if the parser doesn't own the trace file
+}
+
+// fileOwner is implemented by the parsers that can take over the trace file
+// they read from, see OpenAuto.
+type fileOwner interface {
+	own(f io.Closer)
+}
+
+// own makes the parser close f when the parsing ends.
+func (e *emitter) own(f io.Closer) {
+	e.rawFile = f
+}
+
+// Close closes the trace file owned by the parser. The parsing closes it as
+// well, so Close is only needed if the parser isn't run, e.g. after an error.
+// Calling Close more than once or after the parsing is a no-op.
+func (e *emitter) Close() error {
+	if e.rawFile == nil {
+		return nil
+	}
+	err := e.rawFile.Close()
+	e.rawFile = nil
+	return err
+}
+
+// start begins a parser run. out is nil if the raw messages are sent to the
+// output channel.
+func (e *emitter) start(ctx context.Context, out chan<- *FileEntry) {
+	e.ctx = ctx
+	e.recordChan = out
+}
+
+// finish closes the channel of the run and the trace file.
+func (e *emitter) finish() {
+	if e.recordChan != nil {
+		close(e.recordChan)
+	} else {
+		close(e.outputChan)
+	}
+	e.Close()
+}
+
+// cancelled returns the error of the context if the run was cancelled.
+func (e *emitter) cancelled() error {
+	if e.ctx == nil {
+		return nil
+	}
+	return e.ctx.Err()
+}
+
+// done returns the channel closed on cancellation, nil if the run can't be
+// cancelled.
+func (e *emitter) done() <-chan struct{} {
+	if e.ctx == nil {
+		return nil
+	}
+	return e.ctx.Done()
+}
+
+// send sends a marshalled message to the output channel unless the run is
+// cancelled first.
+func (e *emitter) send(buf []byte) error {
+	select {
+	case e.outputChan <- buf:
+		return nil
+	case <-e.done():
+		return e.ctx.Err()
+	}
+}
+
+// sendRecord sends a file entry to the record channel unless the run is
+// cancelled first.
+func (e *emitter) sendRecord(r *FileEntry) error {
+	select {
+	case e.recordChan <- r:
+		return nil
+	case <-e.done():
+		return e.ctx.Err()
+	}
+}
+
+// emit sends a file entry. Fails with the error of the context if the run was
+// cancelled while waiting for the consumer.
+func (e *emitter) emit(f *traceProto.File, chunks []*traceProto.Chunk) error {
+	if e.recordChan != nil {
+		return e.sendRecord(&FileEntry{File: f, Chunks: chunks})
+	}
+
+	buf, err := f.Marshal()
+	if err != nil {
+		return fmt.Errorf("couldn't marshal file entry: %v", err)
+	}
+	if err := e.send(buf); err != nil {
+		return err
+	}
+
+	for _, c := range chunks {
+		if buf, err = c.Marshal(); err != nil {
+			return fmt.Errorf("couldn't marshal file entry: %v", err)
+		}
+		if err := e.send(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
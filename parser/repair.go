@@ -0,0 +1,156 @@
+package parser
+
+import "os"
+import "io"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// RepairReport summarizes what RepairProtoTrace kept and dropped. It is meant
+// to be encoded as JSON.
+type RepairReport struct {
+	Trace           string
+	Files           uint64   // file entries written
+	Chunks          uint64   // chunks written
+	Rewritten       uint64   // file entries whose chunkCount was rewritten
+	PartialFiles    []string // names of the file entries marked as partial
+	Truncated       bool     // the trace ended within a message or a file entry
+	DroppedFiles    uint64   // incomplete file entries dropped
+	DroppedChunks   uint64   // chunks of dropped entries, without file entry or beyond the chunkCount
+	DroppedMessages uint64   // undecodable messages
+	DroppedBytes    int64    // bytes of the (decompressed) input that didn't make it into the output
+}
+
+type RepairOptions struct {
+	DropIncomplete bool // drop incomplete file entries instead of marking them as partial
+}
+
+// repairer collects the messages of a file entry and writes the entry once
+// its end is known.
+type repairer struct {
+	messageReader
+	report  *RepairReport
+	options RepairOptions
+	output  *TraceWriter
+
+	entry      *FileEntry
+	entryBytes int64 // input bytes of the messages of entry
+	keptBytes  int64
+}
+
+// RepairProtoFile repairs the (possibly compressed) fs-c trace at inPath and
+// writes the result to outPath.
+func RepairProtoFile(inPath, outPath string, options RepairOptions) (*RepairReport, error) {
+	f, err := os.Open(inPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	w, err := CreateTraceWriter(outPath)
+	if err != nil {
+		return nil, err
+	}
+	report, err := RepairProtoTrace(inPath, f, w, options)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return report, err
+}
+
+// RepairProtoTrace salvages all complete file entries of the fs-c trace read
+// from r and writes them to w. Undecodable messages and chunks beyond the
+// chunkCount of their file entry, e.g. the chunks of a corrupted file
+// message, are dropped. Entries followed by too few chunks, like the final
+// entry of a truncated trace, are marked as partial and their chunkCount is
+// rewritten, or they are dropped if RepairOptions.DropIncomplete is set. The
+// returned error is only set if r couldn't be read or w couldn't be written.
+func RepairProtoTrace(name string, r io.Reader, w *TraceWriter, options RepairOptions) (*RepairReport, error) {
+	r, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := &repairer{
+		messageReader: newMessageReader(r),
+		report:        &RepairReport{Trace: name},
+		options:       options,
+		output:        w,
+	}
+	if err := rp.run(); err != nil {
+		return rp.report, err
+	}
+	rp.report.DroppedBytes = rp.offset() - rp.keptBytes
+	return rp.report, nil
+}
+
+func (rp *repairer) run() error {
+	for {
+		start := rp.offset()
+		msg, err := rp.readMessage()
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			rp.report.Truncated = true
+			break
+		} else if err == errCorruptSize {
+			// without a valid size the next message can't be found
+			rp.report.Truncated = true
+			break
+		} else if err != nil {
+			return err
+		}
+		size := rp.offset() - start
+
+		f, c := classify(msg)
+		switch {
+		case f != nil:
+			if err := rp.finishEntry(); err != nil {
+				return err
+			}
+			rp.entry = &FileEntry{File: f, Chunks: make([]*traceProto.Chunk, 0, f.GetChunkCount())}
+			rp.entryBytes = size
+		case c != nil && rp.entry != nil && uint32(len(rp.entry.Chunks)) < rp.entry.File.GetChunkCount():
+			rp.entry.Chunks = append(rp.entry.Chunks, c)
+			rp.entryBytes += size
+		case c != nil: // chunks without a file entry or beyond its chunkCount
+			rp.report.DroppedChunks++
+		default:
+			rp.report.DroppedMessages++
+		}
+	}
+
+	if rp.entry != nil && uint32(len(rp.entry.Chunks)) < rp.entry.File.GetChunkCount() {
+		rp.report.Truncated = true
+	}
+	return rp.finishEntry()
+}
+
+// finishEntry writes the collected file entry. An entry with fewer chunks
+// than announced is marked as partial or dropped.
+func (rp *repairer) finishEntry() error {
+	e := rp.entry
+	if e == nil {
+		return nil
+	}
+	rp.entry = nil
+
+	if uint32(len(e.Chunks)) < e.File.GetChunkCount() {
+		if rp.options.DropIncomplete {
+			rp.report.DroppedFiles++
+			rp.report.DroppedChunks += uint64(len(e.Chunks))
+			return nil
+		}
+		e.File.Partial = proto.Bool(true)
+		rp.report.PartialFiles = append(rp.report.PartialFiles, e.File.GetFilename())
+		rp.report.Rewritten++
+	}
+
+	if err := rp.output.WriteEntry(e); err != nil {
+		return err
+	}
+	rp.report.Files++
+	rp.report.Chunks += uint64(len(e.Chunks))
+	rp.keptBytes += rp.entryBytes
+	return nil
+}
@@ -0,0 +1,128 @@
+package parser
+
+import "testing"
+import "bytes"
+
+func repair(t *testing.T, trace []byte, options RepairOptions) (*RepairReport, []*FileEntry) {
+	var out bytes.Buffer
+	w := NewTraceWriter(&out)
+	report, err := RepairProtoTrace("test", bytes.NewReader(trace), w, options)
+	if err != nil {
+		t.Fatalf("Error during repair: %v", err)
+	} else if err := w.Close(); err != nil {
+		t.Fatalf("Repaired trace is incomplete: %v", err)
+	}
+
+	// the repaired trace must be valid and readable by the ProtoParser
+	if v := validate(t, out.Bytes(), ValidationOptions{SkipSizeCheck: true}); !v.Valid {
+		t.Fatalf("Repaired trace is invalid: %+v", v.Issues)
+	}
+	p, err := NewProtoParserFromReader("repaired", bytes.NewReader(out.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("Couldn't initialize ProtoParser: %v", err)
+	}
+	records := make(chan *FileEntry, 100)
+	if err := p.ParseRecords(records); err != nil {
+		t.Fatalf("Couldn't parse repaired trace: %v", err)
+	}
+	entries := make([]*FileEntry, 0)
+	for e := range records {
+		entries = append(entries, e)
+	}
+	return report, entries
+}
+
+func TestRepairValidTrace(t *testing.T) {
+	var buf bytes.Buffer
+	writeValidationEntry(&buf, "a", 2, 10, 20)
+	writeValidationEntry(&buf, "b", 1, 30)
+
+	report, entries := repair(t, buf.Bytes(), RepairOptions{})
+	if len(entries) != 2 || report.Files != 2 || report.Chunks != 3 {
+		t.Fatalf("Wrong result: %+v", report)
+	} else if report.Rewritten != 0 || report.Truncated || report.DroppedBytes != 0 {
+		t.Fatalf("Valid trace was changed: %+v", report)
+	}
+}
+
+func TestRepairChunkCount(t *testing.T) {
+	var buf bytes.Buffer
+	writeValidationEntry(&buf, "a", 3, 10, 20) // one chunk too few
+	writeValidationEntry(&buf, "b", 1, 10, 20) // one chunk too many
+	writeValidationEntry(&buf, "c", 1, 10)
+
+	// the short entry within the trace is treated like a truncated one
+	report, entries := repair(t, buf.Bytes(), RepairOptions{})
+	if report.Rewritten != 1 || report.Truncated || report.DroppedChunks != 1 || len(report.PartialFiles) != 1 || report.PartialFiles[0] != "a" {
+		t.Fatalf("Wrong report: %+v", report)
+	} else if len(entries) != 3 || len(entries[0].Chunks) != 2 || len(entries[1].Chunks) != 1 || len(entries[2].Chunks) != 1 {
+		t.Fatalf("Wrong entries: %v", entries)
+	} else if entries[0].File.GetChunkCount() != 2 || !entries[0].File.GetPartial() {
+		t.Fatalf("Short file wasn't marked as partial: %v", entries[0].File)
+	} else if entries[1].File.GetPartial() || entries[2].File.GetPartial() {
+		t.Fatalf("Complete files were marked as partial: %v, %v", entries[1].File, entries[2].File)
+	}
+
+	report, entries = repair(t, buf.Bytes(), RepairOptions{DropIncomplete: true})
+	if len(entries) != 2 || entries[0].File.GetFilename() != "b" || report.DroppedFiles != 1 || report.DroppedChunks != 3 || len(report.PartialFiles) != 0 {
+		t.Fatalf("Short file wasn't dropped: %+v", report)
+	}
+}
+
+func TestRepairCorruptFile(t *testing.T) {
+	var buf, b bytes.Buffer
+	writeValidationEntry(&buf, "a", 2, 10, 20)
+	buf.Write([]byte{3, 0xff, 0xff, 0xff}) // the file message of b
+	var bFile bytes.Buffer
+	writeValidationEntry(&bFile, "b", 3)
+	writeValidationEntry(&b, "b", 3, 10, 20, 30)
+	buf.Write(b.Bytes()[bFile.Len():])
+	writeValidationEntry(&buf, "c", 1, 10)
+
+	// the chunks of b don't belong to a
+	report, entries := repair(t, buf.Bytes(), RepairOptions{})
+	if report.DroppedMessages != 1 || report.DroppedChunks != 3 || report.Rewritten != 0 || len(report.PartialFiles) != 0 {
+		t.Fatalf("Wrong report: %+v", report)
+	} else if len(entries) != 2 || len(entries[0].Chunks) != 2 || entries[1].File.GetFilename() != "c" {
+		t.Fatalf("Wrong entries: %v", entries)
+	} else if report.DroppedBytes != int64(4+b.Len()-bFile.Len()) {
+		t.Fatalf("Wrong number of dropped bytes: %v", report.DroppedBytes)
+	}
+}
+
+func TestRepairTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	writeValidationEntry(&buf, "a", 2, 10, 20)
+	writeValidationEntry(&buf, "b", 3, 10, 20, 30)
+	var lastEntry, lastChunks bytes.Buffer
+	writeValidationEntry(&lastEntry, "b", 3, 10, 20, 30)
+	writeValidationEntry(&lastChunks, "b", 3, 10, 20)
+	lastChunkSize := int64(lastEntry.Len() - lastChunks.Len())
+	trace := buf.Bytes()[:buf.Len()-3] // ends within the last chunk
+
+	report, entries := repair(t, trace, RepairOptions{})
+	if !report.Truncated || len(report.PartialFiles) != 1 || report.PartialFiles[0] != "b" || report.Files != 2 || report.Chunks != 4 {
+		t.Fatalf("Wrong report: %+v", report)
+	} else if report.DroppedBytes != lastChunkSize-3 {
+		t.Fatalf("Wrong number of dropped bytes: %v", report.DroppedBytes)
+	} else if !entries[1].File.GetPartial() || entries[1].File.GetChunkCount() != 2 {
+		t.Fatalf("Last file wasn't marked as partial: %v", entries[1].File)
+	}
+
+	report, entries = repair(t, trace, RepairOptions{DropIncomplete: true})
+	if len(entries) != 1 || report.DroppedFiles != 1 || report.DroppedChunks != 2 || len(report.PartialFiles) != 0 {
+		t.Fatalf("Incomplete file wasn't dropped: %+v", report)
+	}
+}
+
+func TestRepairUndecodable(t *testing.T) {
+	var buf bytes.Buffer
+	writeValidationEntry(&buf, "a", 1, 10)
+	buf.Write([]byte{3, 0xff, 0xff, 0xff})
+	writeValidationEntry(&buf, "b", 0)
+
+	report, entries := repair(t, buf.Bytes(), RepairOptions{})
+	if report.DroppedMessages != 1 || report.DroppedBytes != 4 || len(entries) != 2 {
+		t.Fatalf("Wrong report: %+v", report)
+	}
+}
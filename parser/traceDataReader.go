@@ -0,0 +1,61 @@
+package parser
+
+import "context"
+
+// The maximum number of file entries a consumer of a TraceDataReader should
+// buffer. Used as capacity of the channel given to FeedAlgorithm.
+const ConstMaxFileEntries = 128
+
+// TraceDataReader reads the file entries of an fs-c trace. Consumers hand the
+// entries back via GetFileEntryReturn once they are done with them so that
+// their buffers are reused for later entries.
+type TraceDataReader struct {
+	filename   string
+	parser     *ProtoParser
+	returnChan chan *FileEntry
+	err        error
+}
+
+func NewTraceDataReader(filename string) *TraceDataReader {
+	return &TraceDataReader{
+		filename:   filename,
+		returnChan: make(chan *FileEntry, 2*ConstMaxFileEntries),
+	}
+}
+
+// FeedAlgorithm parses the whole trace and sends the file entries to out.
+// Closes out when finished; Err reports whether the trace was read completely.
+func (r *TraceDataReader) FeedAlgorithm(out chan<- *FileEntry) {
+	r.FeedAlgorithmContext(context.Background(), out)
+}
+
+// FeedAlgorithmContext is FeedAlgorithm that stops when ctx is cancelled.
+func (r *TraceDataReader) FeedAlgorithmContext(ctx context.Context, out chan<- *FileEntry) {
+	p, err := NewProtoParser(r.filename, nil)
+	if err != nil {
+		r.err = err
+		close(out)
+		return
+	}
+
+	p.SetEntryPool(r.returnChan)
+	r.parser = p
+	p.ParseRecordsContext(ctx, out)
+}
+
+// GetFileEntryReturn returns the channel to hand back processed file entries.
+// An entry must not be used anymore after it was returned.
+func (r *TraceDataReader) GetFileEntryReturn() chan<- *FileEntry {
+	return r.returnChan
+}
+
+// Err returns the error that stopped FeedAlgorithm, if any. It must be called
+// only after the channel given to FeedAlgorithm was closed.
+func (r *TraceDataReader) Err() error {
+	if r.err != nil {
+		return r.err
+	} else if r.parser != nil {
+		return r.parser.err
+	}
+	return nil
+}
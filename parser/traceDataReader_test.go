@@ -0,0 +1,64 @@
+package parser
+
+import "testing"
+import "bytes"
+import "io/ioutil"
+import "path/filepath"
+
+func TestTraceDataReader(t *testing.T) {
+	testdata := protoParseTestInit(t)
+	buf, err := ioutil.ReadFile(testdata["FileWith4Chunks"])
+	if err != nil {
+		t.Fatalf("input file not available")
+	}
+	trace := filepath.Join(t.TempDir(), "traceDataReaderTesting")
+	if err := ioutil.WriteFile(trace, bytes.Repeat(buf, 10), 0666); err != nil {
+		t.Fatalf("Couldn't write test trace: %v", err)
+	}
+
+	// unbuffered so that the reader has to reuse the returned entries
+	fileEntryChan := make(chan *FileEntry)
+	tReader := NewTraceDataReader(trace)
+	go tReader.FeedAlgorithm(fileEntryChan)
+
+	cnt := 0
+	seen := make(map[*FileEntry]bool)
+	for fileEntry := range fileEntryChan {
+		seen[fileEntry] = true
+		if fileEntry.File.GetFilename() != "filename A" {
+			t.Fatalf("Wrong filename: got %v", fileEntry.File.GetFilename())
+		} else if len(fileEntry.Chunks) != 4 {
+			t.Fatalf("Wrong number of chunks: got %v", len(fileEntry.Chunks))
+		}
+		for i, chunk := range fileEntry.Chunks {
+			if len(chunk.GetFp()) != 10 || chunk.GetFp()[0] != byte(i) {
+				t.Fatalf("Chunk %v has wrong fp, got: %x", i, chunk.GetFp())
+			} else if chunk.GetCsize() != uint32(i) {
+				t.Fatalf("Chunk %v has wrong size, got: %v", i, chunk.GetCsize())
+			}
+		}
+		cnt++
+		tReader.GetFileEntryReturn() <- fileEntry
+	}
+
+	if err := tReader.Err(); err != nil {
+		t.Fatalf("Error during reading: %v", err)
+	} else if cnt != 10 {
+		t.Fatalf("Wrong number of file entries: got %v, expected: 10", cnt)
+	} else if len(seen) >= 10 {
+		t.Fatalf("File entries weren't reused: %v different entries", len(seen))
+	}
+}
+
+func TestTraceDataReaderMissingFile(t *testing.T) {
+	fileEntryChan := make(chan *FileEntry)
+	tReader := NewTraceDataReader("doesNotExist")
+	go tReader.FeedAlgorithm(fileEntryChan)
+
+	for _ = range fileEntryChan {
+		t.Fatal("Got file entry for missing file")
+	}
+	if tReader.Err() == nil {
+		t.Fatal("Missing file didn't result in an error")
+	}
+}
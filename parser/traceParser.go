@@ -0,0 +1,151 @@
+package parser
+
+import "context"
+import "fmt"
+import "io"
+import "sort"
+import "sync"
+
+// The trace formats known to this package.
+const (
+	FormatUBC    = "ubc"
+	FormatProto  = "proto"
+	FormatLegacy = "legacy"
+
+	// Detects the format of a trace file, see OpenAuto.
+	FormatAuto = "auto"
+)
+
+// TraceParser is the common interface of all trace parsers. ParseFile parses
+// the whole trace, sends the marshalled traceProto.File and traceProto.Chunk
+// messages to the output channel given at construction and closes it. It
+// returns a *ParseError if the trace is malformed. ParseRecords does the same
+// but sends decoded FileEntry records to out instead and closes out.
+//
+// The Context variants stop at the next file entry or blocked send once ctx
+// is cancelled and return a *ParseError wrapping ctx.Err(). In any case the
+// channel is closed and a trace file opened by the parser is closed when the
+// parsing ends. A parser can be run only once. Close closes the trace file of
+// a parser that isn't run.
+type TraceParser interface {
+	ParseFile() error
+	ParseRecords(out chan<- *FileEntry) error
+	ParseFileContext(ctx context.Context) error
+	ParseRecordsContext(ctx context.Context, out chan<- *FileEntry) error
+	Close() error
+}
+
+// ParserConstructor creates a parser for the given trace file.
+type ParserConstructor func(filepath string, outChan chan<- []byte) (TraceParser, error)
+
+// ReaderConstructor creates a parser that reads a trace from r. The name is
+// used in error messages only.
+type ReaderConstructor func(name string, r io.Reader, outChan chan<- []byte) (TraceParser, error)
+
+var registryLock sync.RWMutex
+var registry = make(map[string]ParserConstructor)
+var readerRegistry = make(map[string]ReaderConstructor)
+
+// Register makes a trace format available to Open. Registering a format twice
+// replaces the former constructor.
+func Register(format string, ctor ParserConstructor) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[format] = ctor
+}
+
+// RegisterReader makes a trace format available to OpenReader.
+func RegisterReader(format string, ctor ReaderConstructor) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	readerRegistry[format] = ctor
+}
+
+// Formats returns the names of all registered trace formats in sorted order.
+func Formats() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	formats := make([]string, 0, len(registry))
+	for f := range registry {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// Open creates a parser for the trace file at filepath using the registered
+// constructor for the given format. FormatAuto detects the format.
+func Open(format string, filepath string, outChan chan<- []byte) (TraceParser, error) {
+	if format == FormatAuto {
+		p, _, err := OpenAuto(filepath, outChan)
+		return p, err
+	}
+
+	registryLock.RLock()
+	ctor, ok := registry[format]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown trace format %q, known formats: %v", format, Formats())
+	}
+	return ctor(filepath, outChan)
+}
+
+// OpenReader creates a parser for the trace read from r using the registered
+// reader constructor for the given format.
+func OpenReader(format string, name string, r io.Reader, outChan chan<- []byte) (TraceParser, error) {
+	registryLock.RLock()
+	ctor, ok := readerRegistry[format]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown trace format %q, known formats: %v", format, Formats())
+	}
+	return ctor(name, r, outChan)
+}
+
+func init() {
+	Register(FormatUBC, func(filepath string, outChan chan<- []byte) (TraceParser, error) {
+		if p, err := NewUBCParser(filepath, outChan); err != nil {
+			return nil, err
+		} else {
+			return p, nil
+		}
+	})
+	Register(FormatProto, func(filepath string, outChan chan<- []byte) (TraceParser, error) {
+		if p, err := NewProtoParser(filepath, outChan); err != nil {
+			return nil, err
+		} else {
+			return p, nil
+		}
+	})
+	Register(FormatLegacy, func(filepath string, outChan chan<- []byte) (TraceParser, error) {
+		if p, err := NewLegacyParser(filepath, outChan); err != nil {
+			return nil, err
+		} else {
+			return p, nil
+		}
+	})
+	RegisterReader(FormatUBC, func(name string, r io.Reader, outChan chan<- []byte) (TraceParser, error) {
+		if p, err := NewUBCParserFromReader(name, r, outChan); err != nil {
+			return nil, err
+		} else {
+			return p, nil
+		}
+	})
+	RegisterReader(FormatProto, func(name string, r io.Reader, outChan chan<- []byte) (TraceParser, error) {
+		if p, err := NewProtoParserFromReader(name, r, outChan); err != nil {
+			return nil, err
+		} else {
+			return p, nil
+		}
+	})
+	RegisterReader(FormatLegacy, func(name string, r io.Reader, outChan chan<- []byte) (TraceParser, error) {
+		if p, err := NewLegacyParserFromReader(name, r, outChan); err != nil {
+			return nil, err
+		} else {
+			return p, nil
+		}
+	})
+}
@@ -0,0 +1,249 @@
+package parser
+
+import "testing"
+import "context"
+import "errors"
+import "io/ioutil"
+import "os"
+import "strings"
+
+func TestFormatsRegistered(t *testing.T) {
+	formats := Formats()
+	if len(formats) != 3 {
+		t.Fatalf("Wrong number of registered formats: got %v, expected: 3", formats)
+	}
+
+	for _, f := range []string{FormatLegacy, FormatProto, FormatUBC} {
+		found := false
+		for _, registered := range formats {
+			found = found || registered == f
+		}
+		if !found {
+			t.Fatalf("Format %v isn't registered: %v", f, formats)
+		}
+	}
+}
+
+func TestOpenUnknownFormat(t *testing.T) {
+	outchan := make(chan []byte)
+	if p, err := Open("unknown", "ubcTesting", outchan); err == nil {
+		t.Fatalf("Open returned parser %v for unknown format", p)
+	}
+}
+
+func TestOpenProto(t *testing.T) {
+	testdata := protoParseTestInit(t)
+
+	messageChan := make(chan []byte, 1000)
+	p, err := Open(FormatProto, testdata["FileWith4Chunks"], messageChan)
+	if err != nil {
+		t.Fatalf("Couldn't open proto trace: %v", err)
+	} else if _, ok := p.(*ProtoParser); !ok {
+		t.Fatalf("Open returned wrong parser type: %T", p)
+	}
+
+	if err := p.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+	cnt := 0
+	for _ = range messageChan {
+		cnt++
+	}
+	if cnt != 5 {
+		t.Fatalf("Wrong number of messages: got %v, expected: 5", cnt)
+	}
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	outchan := make(chan []byte)
+	if _, err := Open(FormatUBC, "doesNotExist", outchan); err == nil {
+		t.Fatal("Open didn't return an error for a missing file")
+	}
+}
+
+func TestOpenReader(t *testing.T) {
+	Init()
+	buf, err := ioutil.ReadFile("ubcSimpleTesting")
+	if err != nil {
+		t.Fatalf("input file not available")
+	}
+
+	// ubcSimpleTesting has no header
+	trace := "Backup Stream\n00000000005c\n\n" + string(buf)
+	recordChan := make(chan *FileEntry, 10)
+	p, err := OpenReader(FormatUBC, "in-memory", strings.NewReader(trace), nil)
+	if err != nil {
+		t.Fatalf("Couldn't open ubc trace from reader: %v", err)
+	}
+	if err := p.ParseRecords(recordChan); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+
+	cnt := 0
+	for e := range recordChan {
+		if len(e.Chunks) != 1 {
+			t.Fatalf("Wrong number of chunks: got %v, expected: 1", len(e.Chunks))
+		}
+		cnt++
+	}
+	if cnt != 3 {
+		t.Fatalf("Wrong number of file entries: got %v, expected: 3", cnt)
+	}
+
+	if _, err := OpenReader("unknown", "in-memory", strings.NewReader(trace), nil); err == nil {
+		t.Fatal("OpenReader succeeded for unknown format")
+	}
+}
+
+func TestOpenAutoFormat(t *testing.T) {
+	testdata := protoParseTestInit(t)
+
+	messageChan := make(chan []byte, 1000)
+	p, err := Open(FormatAuto, testdata["FileWith4Chunks"], messageChan)
+	if err != nil {
+		t.Fatalf("Couldn't open proto trace: %v", err)
+	} else if _, ok := p.(*ProtoParser); !ok {
+		t.Fatalf("Open returned wrong parser type: %T", p)
+	}
+}
+
+// writes a trace with several file entries in each format
+func cancelTestTraces(t *testing.T) (map[string]string, func()) {
+	Init()
+	protoPaths := writePipelineTraces(t, 3)
+
+	w, err := CreateLegacyWriter("legacyCancelTesting")
+	if err != nil {
+		t.Fatalf("Couldn't create legacy test trace: %v", err)
+	}
+	for _, e := range legacyTestEntries() {
+		w.WriteEntry(e)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Couldn't write legacy test trace: %v", err)
+	}
+
+	traces := map[string]string{FormatProto: protoPaths[2], FormatLegacy: "legacyCancelTesting", FormatUBC: "ubcTesting"}
+	return traces, func() {
+		os.Remove("legacyCancelTesting")
+	}
+}
+
+// returns the trace file owned by p
+func rawFile(p TraceParser) *os.File {
+	var owned interface{}
+	switch p := p.(type) {
+	case *ProtoParser:
+		owned = p.rawFile
+	case *UBCParser:
+		owned = p.rawFile
+	case *LegacyParser:
+		owned = p.rawFile
+	}
+	f, _ := owned.(*os.File)
+	return f
+}
+
+func TestParseRecordsCancel(t *testing.T) {
+	traces, cleanup := cancelTestTraces(t)
+	defer cleanup()
+
+	for format, path := range traces {
+		p, err := Open(format, path, nil)
+		if err != nil {
+			t.Fatalf("Couldn't open %v trace: %v", format, err)
+		}
+		f := rawFile(p)
+		if f == nil {
+			t.Fatalf("%v parser doesn't own its trace file", format)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		out := make(chan *FileEntry)
+		errChan := make(chan error, 1)
+		go func() { errChan <- p.ParseRecordsContext(ctx, out) }()
+
+		if _, ok := <-out; !ok {
+			t.Fatalf("%v parser sent no file entry", format)
+		}
+		// the parser blocks on sending the next entry
+		cancel()
+		err = <-errChan
+
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Fatalf("%v parser returned %v instead of a *ParseError", format, err)
+		} else if !errors.Is(err, context.Canceled) {
+			t.Fatalf("%v parser returned %v instead of a cancellation", format, err)
+		} else if parseErr.Record != 1 {
+			t.Fatalf("%v parser stopped at wrong record: got %v, expected: 1", format, parseErr.Record)
+		}
+		if _, ok := <-out; ok {
+			t.Fatalf("%v parser didn't close the channel", format)
+		}
+		if err := f.Close(); err == nil {
+			t.Fatalf("%v parser didn't close its trace file", format)
+		}
+	}
+}
+
+func TestParseFileCancelled(t *testing.T) {
+	traces, cleanup := cancelTestTraces(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for format, path := range traces {
+		out := make(chan []byte)
+		p, err := Open(format, path, out)
+		if err != nil {
+			t.Fatalf("Couldn't open %v trace: %v", format, err)
+		}
+		if err := p.ParseFileContext(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%v parser returned %v instead of a cancellation", format, err)
+		}
+		if _, ok := <-out; ok {
+			t.Fatalf("%v parser sent a message after the cancellation", format)
+		}
+	}
+}
+
+func TestOpenAutoOwnsFile(t *testing.T) {
+	traces, cleanup := cancelTestTraces(t)
+	defer cleanup()
+
+	p, _, err := OpenAuto(traces[FormatProto], make(chan []byte, 100))
+	if err != nil {
+		t.Fatalf("Couldn't open proto trace: %v", err)
+	}
+	f := rawFile(p)
+	if f == nil {
+		t.Fatal("OpenAuto didn't hand the trace file to the parser")
+	}
+	if err := p.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+	if err := f.Close(); err == nil {
+		t.Fatal("Parser didn't close its trace file")
+	}
+}
+
+func TestCloseUnparsed(t *testing.T) {
+	traces, cleanup := cancelTestTraces(t)
+	defer cleanup()
+
+	for format, trace := range traces {
+		p, err := Open(format, trace, make(chan []byte, 100))
+		if err != nil {
+			t.Fatalf("Couldn't open %v trace: %v", format, err)
+		}
+		f := rawFile(p)
+		if err := p.Close(); err != nil {
+			t.Fatalf("Couldn't close %v parser: %v", format, err)
+		} else if err := f.Close(); err == nil {
+			t.Fatalf("%v parser didn't close its trace file", format)
+		} else if err := p.Close(); err != nil {
+			t.Fatalf("Closing the %v parser twice failed: %v", format, err)
+		}
+	}
+}
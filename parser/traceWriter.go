@@ -0,0 +1,163 @@
+package parser
+
+import "os"
+import "bufio"
+import "io"
+import "fmt"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// TraceWriter writes fs-c traces, i.e. varint-delimited traceProto.File
+// messages, each followed by File.ChunkCount traceProto.Chunk messages. It
+// checks that every file is followed by the announced number of chunks.
+type TraceWriter struct {
+	file   *os.File // nil if the writer doesn't own the output
+	output *bufio.Writer
+
+	files           int    // number of file entries written
+	remainingChunks uint32 // chunks still missing for the current file
+
+	index  *IndexWriter // nil if no index is written
+	offset int64        // bytes written
+	bytes  uint64       // sum of the file sizes written
+}
+
+// NewTraceWriter creates a buffered TraceWriter on top of w. Closing the
+// TraceWriter doesn't close w.
+func NewTraceWriter(w io.Writer) *TraceWriter {
+	return &TraceWriter{output: bufio.NewWriterSize(w, 4*1024*1024)}
+}
+
+// CreateTraceWriter creates or truncates the file at filepath and returns a
+// TraceWriter for it.
+func CreateTraceWriter(filepath string) (*TraceWriter, error) {
+	f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	w := NewTraceWriter(f)
+	w.file = f
+	return w, nil
+}
+
+// Files returns the number of file entries written so far.
+func (w *TraceWriter) Files() int {
+	return w.files
+}
+
+// SetIndex makes the writer add an entry for every file entry it writes to
+// ix. The offsets are only valid if the writer starts at the beginning of the
+// trace and its output isn't compressed. Closing the writer doesn't close ix.
+func (w *TraceWriter) SetIndex(ix *IndexWriter) {
+	w.index = ix
+}
+
+// WriteFile writes the header of the next file entry. All chunks of the
+// previous entry must have been written.
+func (w *TraceWriter) WriteFile(f *traceProto.File) error {
+	buf, err := f.Marshal()
+	if err != nil {
+		return err
+	}
+	return w.writeFile(buf, f)
+}
+
+// WriteChunk writes the next chunk of the current file entry.
+func (w *TraceWriter) WriteChunk(c *traceProto.Chunk) error {
+	buf, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+	return w.writeChunk(buf)
+}
+
+// WriteEntry writes a whole file entry. File.ChunkCount is set to the number
+// of chunks of the entry.
+func (w *TraceWriter) WriteEntry(e *FileEntry) error {
+	e.File.ChunkCount = proto.Uint32(uint32(len(e.Chunks)))
+	if err := w.WriteFile(e.File); err != nil {
+		return err
+	}
+	for _, c := range e.Chunks {
+		if err := w.WriteChunk(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteMessage writes an already marshalled message as produced by the
+// parsers. Whether it is a file or a chunk is derived from its position in
+// the trace.
+func (w *TraceWriter) WriteMessage(msg []byte) error {
+	if w.remainingChunks > 0 {
+		return w.writeChunk(msg)
+	}
+
+	f := new(traceProto.File)
+	if err := f.Unmarshal(msg); err != nil {
+		return fmt.Errorf("couldn't unmarshal file message %v: %v", w.files, err)
+	}
+	return w.writeFile(msg, f)
+}
+
+func (w *TraceWriter) writeFile(msg []byte, f *traceProto.File) error {
+	if w.remainingChunks > 0 {
+		return fmt.Errorf("file entry %v is missing %v chunks", w.files-1, w.remainingChunks)
+	}
+	if w.index != nil {
+		e := IndexEntry{File: w.files, Offset: w.offset, ChunkCount: f.GetChunkCount(), Bytes: w.bytes}
+		if err := w.index.Write(e); err != nil {
+			return err
+		}
+	}
+	if err := w.writeDelimited(msg); err != nil {
+		return err
+	}
+	w.files++
+	w.remainingChunks = f.GetChunkCount()
+	w.bytes += f.GetFsize()
+	return nil
+}
+
+func (w *TraceWriter) writeChunk(msg []byte) error {
+	if w.remainingChunks == 0 {
+		return fmt.Errorf("file entry %v already has all of its chunks", w.files-1)
+	}
+	if err := w.writeDelimited(msg); err != nil {
+		return err
+	}
+	w.remainingChunks--
+	return nil
+}
+
+func (w *TraceWriter) writeDelimited(msg []byte) error {
+	size := proto.EncodeVarint(uint64(len(msg)))
+	if _, err := w.output.Write(size); err != nil {
+		return err
+	}
+	_, err := w.output.Write(msg)
+	w.offset += int64(len(size) + len(msg))
+	return err
+}
+
+// Flush writes all buffered data to the underlying writer.
+func (w *TraceWriter) Flush() error {
+	return w.output.Flush()
+}
+
+// Close flushes the writer and closes the output file if it was created by
+// CreateTraceWriter. Returns an error if the last file entry is incomplete.
+func (w *TraceWriter) Close() error {
+	err := w.output.Flush()
+	if w.file != nil {
+		if cerr := w.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil && w.remainingChunks > 0 {
+		err = fmt.Errorf("file entry %v is missing %v chunks", w.files-1, w.remainingChunks)
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package parser
+
+import "testing"
+import "bytes"
+import "os"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+func TestTraceWriterRoundTrip(t *testing.T) {
+	w, err := CreateTraceWriter("protoTestingWriter")
+	if err != nil {
+		t.Fatalf("Couldn't create trace writer: %v", err)
+	}
+	defer os.Remove("protoTestingWriter")
+
+	for i := 0; i < 3; i++ {
+		e := &FileEntry{File: &traceProto.File{Filename: proto.String("file"), Fsize: proto.Uint64(uint64(i))}}
+		for j := 0; j < i; j++ {
+			e.Chunks = append(e.Chunks, &traceProto.Chunk{Fp: []byte{byte(i), byte(j)}, Csize: proto.Uint32(uint32(j))})
+		}
+		if err := w.WriteEntry(e); err != nil {
+			t.Fatalf("Couldn't write entry %v: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Couldn't close trace writer: %v", err)
+	} else if w.Files() != 3 {
+		t.Fatalf("Wrong number of written files: got %v, expected: 3", w.Files())
+	}
+
+	protoParser, err := NewProtoParser("protoTestingWriter", nil)
+	if err != nil {
+		t.Fatalf("Couldn't initialize ProtoParser: %v", err)
+	}
+	recordChan := make(chan *FileEntry, 10)
+	if err := protoParser.ParseRecords(recordChan); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+
+	i := 0
+	for e := range recordChan {
+		if e.File.GetFsize() != uint64(i) {
+			t.Fatalf("Wrong file size: got %v, expected: %v", e.File.GetFsize(), i)
+		} else if len(e.Chunks) != i {
+			t.Fatalf("Wrong number of chunks: got %v, expected: %v", len(e.Chunks), i)
+		}
+		for j, c := range e.Chunks {
+			if !bytes.Equal(c.GetFp(), []byte{byte(i), byte(j)}) {
+				t.Fatalf("Chunk %v of file %v has wrong fp: got %x", j, i, c.GetFp())
+			}
+		}
+		i++
+	}
+	if i != 3 {
+		t.Fatalf("Wrong number of file entries: got %v, expected: 3", i)
+	}
+}
+
+func TestTraceWriterChunkCount(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewTraceWriter(&buf)
+
+	chunk := &traceProto.Chunk{Fp: []byte{1}, Csize: proto.Uint32(1)}
+	if err := w.WriteChunk(chunk); err == nil {
+		t.Fatal("Writing a chunk without file succeeded")
+	}
+
+	if err := w.WriteFile(&traceProto.File{Filename: proto.String("a"), ChunkCount: proto.Uint32(2)}); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	} else if err := w.WriteChunk(chunk); err != nil {
+		t.Fatalf("Couldn't write chunk: %v", err)
+	}
+
+	if err := w.WriteFile(&traceProto.File{Filename: proto.String("b")}); err == nil {
+		t.Fatal("Writing a file while chunks are missing succeeded")
+	}
+	if err := w.Close(); err == nil {
+		t.Fatal("Closing with an incomplete file entry succeeded")
+	}
+}
+
+func TestTraceWriterMessages(t *testing.T) {
+	testdata := protoParseTestInit(t)
+
+	messageChan := make(chan []byte, 1000)
+	protoParser, err := NewProtoParser(testdata["FileWith4Chunks"], messageChan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize ProtoParser: %v", err)
+	}
+	if err := protoParser.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := NewTraceWriter(&buf)
+	for m := range messageChan {
+		if err := w.WriteMessage(m); err != nil {
+			t.Fatalf("Couldn't write message: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Couldn't close trace writer: %v", err)
+	}
+
+	f, _ := os.Open(testdata["FileWith4Chunks"])
+	defer f.Close()
+	var orig bytes.Buffer
+	orig.ReadFrom(f)
+	if !bytes.Equal(buf.Bytes(), orig.Bytes()) {
+		t.Fatal("Rewritten trace differs from the original")
+	}
+}
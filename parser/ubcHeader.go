@@ -0,0 +1,39 @@
+package parser
+
+import "strconv"
+import "strings"
+
+// UBCHeader is the header block of a UBC trace. It describes the traced
+// machine and volume. The first six lines are positional, the others are
+// "Key:Value" lines.
+type UBCHeader struct {
+	StreamType      string
+	Hostname        string // hashed
+	Username        string // hashed
+	SystemDirectory string
+	CurrentTime     int64 // Unix time of the trace run. 0 if the line isn't a number
+	OS              string
+
+	Fields map[string]string // the "Key:Value" lines, e.g. Filesystem, SerialNumber or Procs
+	Extra  []string          // further lines that are no "Key:Value" lines
+}
+
+func parseUBCHeader(lines []string) *UBCHeader {
+	h := &UBCHeader{Fields: make(map[string]string)}
+	positional := []*string{&h.StreamType, &h.Hostname, &h.Username, &h.SystemDirectory, nil, &h.OS}
+
+	for i, line := range lines {
+		if i < len(positional) {
+			if positional[i] != nil {
+				*positional[i] = line
+			} else {
+				h.CurrentTime, _ = strconv.ParseInt(line, 10, 64)
+			}
+		} else if sep := strings.Index(line, ":"); sep > 0 {
+			h.Fields[line[:sep]] = line[sep+1:]
+		} else {
+			h.Extra = append(h.Extra, line)
+		}
+	}
+	return h
+}
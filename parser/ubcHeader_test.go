@@ -0,0 +1,52 @@
+package parser
+
+import "testing"
+import "strings"
+
+func TestUBCHeader(t *testing.T) {
+	p, err := NewUBCParser("ubcTesting", nil)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
+	}
+
+	h, err := p.Header()
+	if err != nil {
+		t.Fatalf("Couldn't read header: %v", err)
+	} else if h.StreamType != "Backup Stream" || h.Hostname != "00000000005c" || h.Username != "00000000005c" {
+		t.Fatalf("Wrong header: %+v", h)
+	} else if h.SystemDirectory != `C:\\Windows\\system32` || h.CurrentTime != 1252126932 {
+		t.Fatalf("Wrong header: %+v", h)
+	} else if !strings.HasPrefix(h.OS, "Microsoft Windows Vista") {
+		t.Fatalf("Wrong OS: %v", h.OS)
+	} else if h.Fields["Filesystem"] != "NTFS" || h.Fields["VolumeName"] != "<Not Collected>" || h.Fields["NTFSMinorVersion"] != "1" {
+		t.Fatalf("Wrong fields: %v", h.Fields)
+	} else if len(h.Extra) != 0 {
+		t.Fatalf("Unexpected extra lines: %v", h.Extra)
+	}
+
+	// parsing continues after the header
+	records := make(chan *FileEntry, 1000)
+	if err := p.ParseRecords(records); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+	if e := <-records; e.File.GetFilename() != "73e29ea83da7e8b0dee6c584233beb" {
+		t.Fatalf("Wrong first file entry: %v", e.File)
+	}
+	if again, _ := p.Header(); again != h {
+		t.Fatal("Header changed after parsing")
+	}
+}
+
+func TestParseUBCHeader(t *testing.T) {
+	h := parseUBCHeader([]string{"Backup Stream", "host", "user", "C:\\Windows", "notANumber", "OS", "Procs:2", "garbage"})
+	if h.CurrentTime != 0 || h.OS != "OS" {
+		t.Fatalf("Wrong header: %+v", h)
+	} else if h.Fields["Procs"] != "2" || len(h.Extra) != 1 || h.Extra[0] != "garbage" {
+		t.Fatalf("Wrong fields: %v, %v", h.Fields, h.Extra)
+	}
+
+	// short headers leave the missing fields empty
+	if h := parseUBCHeader([]string{"Backup Stream"}); h.StreamType != "Backup Stream" || h.Hostname != "" {
+		t.Fatalf("Wrong header: %+v", h)
+	}
+}
@@ -0,0 +1,112 @@
+package parser
+
+import "os"
+import "bufio"
+import "io"
+import "strconv"
+import "time"
+import "encoding/json"
+
+// The number of metadata lines following the file size of a UBC file entry.
+const ubcMetadataLines = 7
+
+// The difference between the Windows FILETIME epoch (1601-01-01) and the Unix
+// epoch in 100ns intervals.
+const filetimeUnixOffset = 116444736000000000
+
+// UBCFileMetadata holds the metadata of a UBC file entry that has no
+// counterpart in traceProto.File.
+type UBCFileMetadata struct {
+	Filename   string   // File.filename of the converted entry
+	Name       UBCName  // the hashed name components
+	Metadata   []string // the 7 metadata lines following the file size, verbatim
+	Fragments  []string // the SV:, V: and A: fragmentation lines, verbatim
+	ZeroChunks uint32   // number of chunks consisting of zeros only
+	ZeroBytes  uint64
+
+	// Windows FILETIMEs taken from the last 3 metadata lines. 0 if a line
+	// isn't a number.
+	CreationTime   int64
+	LastAccessTime int64
+	LastWriteTime  int64
+}
+
+func (m *UBCFileMetadata) parseTimes() {
+	if len(m.Metadata) != ubcMetadataLines {
+		return
+	}
+	times := []*int64{&m.CreationTime, &m.LastAccessTime, &m.LastWriteTime}
+	for i, t := range times {
+		*t, _ = strconv.ParseInt(m.Metadata[ubcMetadataLines-len(times)+i], 10, 64)
+	}
+}
+
+// FiletimeToTime converts a Windows FILETIME, i.e. the number of 100ns
+// intervals since 1601-01-01 UTC, to a time.Time.
+func FiletimeToTime(filetime int64) time.Time {
+	unix100ns := filetime - filetimeUnixOffset
+	return time.Unix(unix100ns/1e7, (unix100ns%1e7)*100).UTC()
+}
+
+// UBCMetadataWriter writes UBCFileMetadata as JSON lines, one line per file
+// entry. Line N belongs to file entry N of the trace written alongside.
+type UBCMetadataWriter struct {
+	file    *os.File // nil if the writer doesn't own the output
+	output  *bufio.Writer
+	encoder *json.Encoder
+}
+
+// NewUBCMetadataWriter creates a buffered UBCMetadataWriter on top of w.
+// Closing the writer doesn't close w.
+func NewUBCMetadataWriter(w io.Writer) *UBCMetadataWriter {
+	output := bufio.NewWriter(w)
+	return &UBCMetadataWriter{output: output, encoder: json.NewEncoder(output)}
+}
+
+// CreateUBCMetadataWriter creates or truncates the file at filepath and
+// returns a UBCMetadataWriter for it.
+func CreateUBCMetadataWriter(filepath string) (*UBCMetadataWriter, error) {
+	f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	w := NewUBCMetadataWriter(f)
+	w.file = f
+	return w, nil
+}
+
+// Write writes the metadata of the next file entry. It can be used as
+// handler for UBCParser.SetMetadataHandler.
+func (w *UBCMetadataWriter) Write(m *UBCFileMetadata) error {
+	return w.encoder.Encode(m)
+}
+
+// Close flushes the writer and closes the output file if it was created by
+// CreateUBCMetadataWriter.
+func (w *UBCMetadataWriter) Close() error {
+	err := w.output.Flush()
+	if w.file != nil {
+		if cerr := w.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// UBCMetadataReader reads the JSON lines written by UBCMetadataWriter.
+type UBCMetadataReader struct {
+	decoder *json.Decoder
+}
+
+func NewUBCMetadataReader(r io.Reader) *UBCMetadataReader {
+	return &UBCMetadataReader{decoder: json.NewDecoder(bufio.NewReader(r))}
+}
+
+// Read returns the metadata of the next file entry or io.EOF after the last.
+func (r *UBCMetadataReader) Read() (*UBCFileMetadata, error) {
+	m := new(UBCFileMetadata)
+	if err := r.decoder.Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,82 @@
+package parser
+
+import "testing"
+import "bytes"
+import "io"
+import "reflect"
+import "time"
+
+func TestUBCMetadata(t *testing.T) {
+	outchan := make(chan []byte, 1e6)
+	p, err := NewUBCParser("ubcTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
+	}
+	metadata := make([]*UBCFileMetadata, 0)
+	p.SetMetadataHandler(func(m *UBCFileMetadata) error {
+		metadata = append(metadata, m)
+		return nil
+	})
+	if err := p.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+
+	if len(metadata) < 4 {
+		t.Fatalf("Got metadata for %v file entries only", len(metadata))
+	}
+	expected := []string{"16", "8444249301483345", "1", "0", "128069398392366250", "128932114418389156", "128932114418389156"}
+	if !reflect.DeepEqual(metadata[0].Metadata, expected) {
+		t.Fatalf("Wrong metadata lines: got %v, expected: %v", metadata[0].Metadata, expected)
+	} else if metadata[0].Filename != "73e29ea83da7e8b0dee6c584233beb" {
+		t.Fatalf("Wrong filename: %v", metadata[0].Filename)
+	} else if metadata[0].CreationTime != 128069398392366250 || metadata[0].LastWriteTime != 128932114418389156 {
+		t.Fatalf("Wrong times: %+v", metadata[0])
+	}
+
+	if !reflect.DeepEqual(metadata[0].Fragments, []string{"SV:0"}) {
+		t.Fatalf("Wrong fragments of file 0: %v", metadata[0].Fragments)
+	} else if !reflect.DeepEqual(metadata[1].Fragments, []string{"SV:0", "V:2:L:1147380"}) {
+		t.Fatalf("Wrong fragments of file 1: %v", metadata[1].Fragments)
+	} else if len(metadata[2].Fragments) != 0 {
+		t.Fatalf("Wrong fragments of file 2: %v", metadata[2].Fragments)
+	}
+}
+
+func TestUBCMetadataWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewUBCMetadataWriter(&buf)
+	written := []*UBCFileMetadata{
+		{Filename: "a", Metadata: []string{"1", "2"}, Fragments: []string{"SV:0"}, CreationTime: 42},
+		{Filename: "b"},
+	}
+	for _, m := range written {
+		if err := w.Write(m); err != nil {
+			t.Fatalf("Couldn't write metadata: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Couldn't close writer: %v", err)
+	} else if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines != 2 {
+		t.Fatalf("Wrong number of lines: %v", lines)
+	}
+
+	r := NewUBCMetadataReader(&buf)
+	for i := range written {
+		if m, err := r.Read(); err != nil {
+			t.Fatalf("Couldn't read metadata %v: %v", i, err)
+		} else if !reflect.DeepEqual(m, written[i]) {
+			t.Fatalf("Wrong metadata: got %+v, expected: %+v", m, written[i])
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+func TestFiletimeToTime(t *testing.T) {
+	if ft := FiletimeToTime(filetimeUnixOffset); !ft.Equal(time.Unix(0, 0)) {
+		t.Fatalf("Wrong unix epoch: %v", ft)
+	} else if ft := FiletimeToTime(128932114418389156); ft.Year() != 2009 {
+		t.Fatalf("Wrong time: %v", ft)
+	}
+}
@@ -0,0 +1,53 @@
+package parser
+
+import "fmt"
+import "strconv"
+
+// UBCName holds the hashed name components of a UBC file entry. UBC traces
+// don't contain names, but hashes of the directory path, the file name and
+// the extension, each with the length of the hashed string.
+type UBCName struct {
+	DirHash    string
+	DirLength  int // length of the directory path
+	FileHash   string
+	FileLength int
+	ExtHash    string
+	ExtLength  int // 0 if the file has no extension
+}
+
+// builds the name from the "hash:length" submatches of the first three lines
+// of a file entry
+func newUBCName(dirInfo, fileInfo, extensionInfo []string) (UBCName, error) {
+	n := UBCName{DirHash: dirInfo[1], FileHash: fileInfo[1], ExtHash: extensionInfo[1]}
+	for _, c := range []struct {
+		match  []string
+		length *int
+	}{
+		{dirInfo, &n.DirLength},
+		{fileInfo, &n.FileLength},
+		{extensionInfo, &n.ExtLength},
+	} {
+		l, err := strconv.Atoi(c.match[2])
+		if err != nil {
+			return n, fmt.Errorf("couldn't parse length in %q: %v", c.match[0], err)
+		}
+		*c.length = l
+	}
+	return n, nil
+}
+
+// Concatenated returns the hashes concatenated without separator. This is the
+// traditional File.filename of converted UBC traces.
+func (n UBCName) Concatenated() string {
+	return n.DirHash + n.FileHash + n.ExtHash
+}
+
+// Path returns a path-like name "dirhash/filehash.exthash". The extension is
+// left out if the file has none. path.Dir of the name yields the directory
+// hash, so results can be grouped per directory.
+func (n UBCName) Path() string {
+	if n.ExtLength == 0 {
+		return n.DirHash + "/" + n.FileHash
+	}
+	return n.DirHash + "/" + n.FileHash + "." + n.ExtHash
+}
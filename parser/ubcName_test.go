@@ -0,0 +1,51 @@
+package parser
+
+import "testing"
+
+func TestUBCName(t *testing.T) {
+	n, err := newUBCName([]string{"73e29ea83d:1", "73e29ea83d", "1"}, []string{"ec58962838:32", "ec58962838", "32"}, []string{"535740fe05:3", "535740fe05", "3"})
+	if err != nil {
+		t.Fatalf("Couldn't build name: %v", err)
+	} else if n.DirHash != "73e29ea83d" || n.DirLength != 1 || n.FileHash != "ec58962838" || n.FileLength != 32 || n.ExtLength != 3 {
+		t.Fatalf("Wrong name components: %+v", n)
+	} else if n.Concatenated() != "73e29ea83dec58962838535740fe05" {
+		t.Fatalf("Wrong concatenated name: %v", n.Concatenated())
+	} else if n.Path() != "73e29ea83d/ec58962838.535740fe05" {
+		t.Fatalf("Wrong path: %v", n.Path())
+	}
+
+	n.ExtLength = 0
+	if n.Path() != "73e29ea83d/ec58962838" {
+		t.Fatalf("Wrong path without extension: %v", n.Path())
+	}
+
+	if _, err := newUBCName([]string{"a:99999999999999999999", "a", "99999999999999999999"}, []string{"b:1", "b", "1"}, []string{"c:1", "c", "1"}); err == nil {
+		t.Fatal("Overflowing length wasn't rejected")
+	}
+}
+
+func TestUBCPathNames(t *testing.T) {
+	p, err := NewUBCParser("ubcTesting", nil)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
+	}
+	p.SetPathNames(true)
+	var names []UBCName
+	p.SetMetadataHandler(func(m *UBCFileMetadata) error {
+		names = append(names, m.Name)
+		return nil
+	})
+
+	records := make(chan *FileEntry, 1000)
+	if err := p.ParseRecords(records); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+	e := <-records
+	if e.File.GetFilename() != "73e29ea83d/a7e8b0dee6" {
+		t.Fatalf("Wrong path name: %v", e.File.GetFilename())
+	} else if e.File.GetLabel() != "c584233beb" {
+		t.Fatalf("Wrong label: %v", e.File.GetLabel())
+	} else if names[0].DirLength != 1 || names[0].FileHash != "a7e8b0dee6" || names[0].FileLength != 8 {
+		t.Fatalf("Wrong name components: %+v", names[0])
+	}
+}
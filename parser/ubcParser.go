@@ -2,7 +2,9 @@ package parser
 
 import "os"
 import "bufio"
+import "context"
 import "io"
+import "fmt"
 import "strings"
 import "strconv"
 import "regexp"
@@ -11,133 +13,280 @@ import "encoding/hex"
 import "github.com/gogo/protobuf/proto"
 import "github.com/jkaiser/dedup_tools/traceProto"
 
-import log "github.com/cihub/seelog"
-
 type UBCParser struct {
 	filename      string
 	file          *bufio.Reader
-	outputChan    chan<- []byte
+	counter       *countingReader
 	colonSeperate *regexp.Regexp
+	emitter
+
+	lineOffset      int64                        // offset of the last line read by readLine
+	record          int                          // number of the current file entry
+	err             error                        // the error that stopped the parsing
+	metadataHandler func(*UBCFileMetadata) error // nil if the metadata isn't collected
+	pathNames       bool                         // use UBCName.Path as File.filename
+	header          *UBCHeader                   // nil until the header was read
+	zeroChunkPolicy string                       // one of the ZeroChunk* policies. Empty means ZeroChunkLegacy
+	fpLen           int                          // length of the last regular fingerprint, 0 if none was seen yet
+	zeroStats       ZeroChunkStats
+}
+
+func NewUBCParser(filepath string, outChan chan<- []byte) (*UBCParser, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	parser, err := NewUBCParserFromReader(filepath, f, outChan)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	parser.own(f)
+	return parser, nil
 }
 
-func NewUBCParser(filepath string, outChan chan<- []byte) *UBCParser {
+// NewUBCParserFromReader creates a parser that reads the trace from r. The name
+// is used in error messages only.
+func NewUBCParserFromReader(name string, r io.Reader, outChan chan<- []byte) (*UBCParser, error) {
 	parser := new(UBCParser)
-	parser.filename = filepath
+	parser.filename = name
 	parser.outputChan = outChan
 	if re, err := regexp.Compile("([0-9a-fz]+):([0-9]+)"); err != nil {
-		log.Error(err)
-		return nil
+		return nil, err
 	} else {
 		parser.colonSeperate = re
 	}
 
-	if f, err := os.Open(filepath); err != nil {
-		log.Error("Couldn't open file to parse: ", err)
-		return nil
+	if r, err := decompress(r); err != nil {
+		return nil, err
 	} else {
-		parser.file = bufio.NewReaderSize(f, 4*1024*1024)
-		return parser
+		parser.counter = &countingReader{r: r}
+		parser.file = bufio.NewReaderSize(parser.counter, 4*1024*1024)
+		return parser, nil
 	}
 }
 
-func (p *UBCParser) skipHeader() bool {
+// SetMetadataHandler makes the parser collect the UBC metadata of every file
+// entry, which doesn't fit into traceProto.File. h is called for each entry
+// right before the entry itself is emitted. An error returned by h stops the
+// parsing.
+func (p *UBCParser) SetMetadataHandler(h func(*UBCFileMetadata) error) {
+	p.metadataHandler = h
+}
+
+// SetPathNames makes the parser use path-like names "dirhash/filehash.exthash"
+// (see UBCName.Path) as File.filename instead of the concatenated hashes.
+func (p *UBCParser) SetPathNames(pathNames bool) {
+	p.pathNames = pathNames
+}
+
+// readLine reads the next line and trims the surrounding whitespace. A last
+// line without trailing newline is returned without error.
+func (p *UBCParser) readLine() (string, error) {
+	p.lineOffset = p.counter.n - int64(p.file.Buffered())
 	line, err := p.file.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	return strings.TrimSpace(line), err
+}
+
+func (p *UBCParser) fail(format string, args ...interface{}) bool {
+	return p.failErr(fmt.Errorf(format, args...))
+}
+
+func (p *UBCParser) failErr(err error) bool {
+	p.err = &ParseError{Filename: p.filename, Offset: p.lineOffset, Record: p.record, Err: err}
+	return false
+}
+
+func (p *UBCParser) readHeader() bool {
+	line, err := p.readLine()
 	if err != nil {
-		log.Error("Error while parsing header: ", err)
-		panic(err)
+		return p.fail("couldn't read header: %v", err)
 	}
 
+	lines := make([]string, 0, 32)
 	for (err == nil) && len(line) > 0 {
-		line, err = p.file.ReadString('\n')
-		line = strings.TrimSpace(line)
+		lines = append(lines, line)
+		line, err = p.readLine()
 	}
 
 	if err != nil {
-		log.Error("Error while parsing header: ", err)
-		panic(err)
+		return p.fail("header isn't terminated by an empty line: %v", err)
 	}
 
+	p.header = parseUBCHeader(lines)
 	return true
 }
 
-// Parses the whole file
-func (p *UBCParser) ParseFile() {
+// Header reads the header block of the trace if it wasn't read yet and returns
+// it. It must be called before parsing starts or after it finished.
+func (p *UBCParser) Header() (*UBCHeader, error) {
+	if p.header == nil && p.err == nil {
+		p.readHeader()
+	}
+	return p.header, p.err
+}
+
+// Parses the whole file. Returns a *ParseError if the trace is malformed.
+func (p *UBCParser) ParseFile() error {
+	return p.ParseFileContext(context.Background())
+}
 
-	p.skipHeader()
-	for p.parseFileEntry() {
+// ParseFileContext parses the whole file until ctx is cancelled. The returned
+// *ParseError wraps ctx.Err() if the parsing was cancelled.
+func (p *UBCParser) ParseFileContext(ctx context.Context) error {
+	p.start(ctx, nil)
+	p.parse()
+	p.finish()
+	return p.err
+}
+
+// Parses the whole file and sends the decoded file entries to out instead of
+// the output channel. Closes out when finished.
+func (p *UBCParser) ParseRecords(out chan<- *FileEntry) error {
+	return p.ParseRecordsContext(context.Background(), out)
+}
+
+// ParseRecordsContext is ParseRecords that stops when ctx is cancelled.
+func (p *UBCParser) ParseRecordsContext(ctx context.Context, out chan<- *FileEntry) error {
+	p.start(ctx, out)
+	p.parse()
+	p.finish()
+	return p.err
+}
+
+func (p *UBCParser) parse() {
+	if _, err := p.Header(); err != nil {
+		return
+	}
+	for {
+		if err := p.cancelled(); err != nil {
+			p.failErr(err)
+			return
+		}
+		if !p.parseFileEntry() {
+			return
+		}
+		p.record++
 	}
-	close(p.outputChan)
 }
 
-func (p *UBCParser) parseChunks() [][]byte {
-	chunks := make([][]byte, 0, 100)
+// parseChunks reads the rest of a file entry. The metadata and fragmentation
+// lines are skipped unless meta is given.
+func (p *UBCParser) parseChunks(meta *UBCFileMetadata) []*traceProto.Chunk {
+	chunks := make([]*traceProto.Chunk, 0, 100)
 
 	var err error
 	var line string
+	var zeroChunks uint32
+	var zeroBytes uint64
 
-	// skip rest of the 7 file metainfo lines
-	for i := 0; i < 7; i++ {
-		line, err = p.file.ReadString('\n')
-		if err != nil {
-			log.Error("Couldn't parse line: ", err)
+	// rest of the 7 file metainfo lines
+	for i := 0; i < ubcMetadataLines; i++ {
+		if line, err = p.readLine(); err != nil {
+			p.fail("couldn't read file metainfo line %v: %v", i, err)
 			return nil
 		}
+		if meta != nil {
+			meta.Metadata = append(meta.Metadata, line)
+		}
 	}
 
-	// skip file frag information
+	// file frag information
 	for {
-		line, err = p.file.ReadString('\n')
-		if err != nil {
-			log.Error("Couldn't read frag info line: ", err)
+		if line, err = p.readLine(); err == io.EOF {
+			line = ""
+			break
+		} else if err != nil {
+			p.fail("couldn't read frag info line: %v", err)
 			return nil
 		}
 
-		line = strings.TrimSpace(line)
 		if !(strings.HasPrefix(line, "SV:") || strings.HasPrefix(line, "V:") || strings.HasPrefix(line, "A:")) {
 			break
 		}
+		if meta != nil {
+			meta.Fragments = append(meta.Fragments, line)
+		}
 	}
 
 	// read chunks
-	protoChunk := new(traceProto.Chunk)
 	for len(line) > 0 {
+		protoChunk := new(traceProto.Chunk)
 		lineParts := strings.Split(line, ":")
 		if len(lineParts) != 2 {
-			log.Error("Found strange line while parsing chunk: \n", line, ", parts: ", lineParts)
+			p.fail("malformed chunk line %q", line)
+			return nil
 		}
 
-		if lineParts[0] == "zzzzzzzzzzzz" {
-			protoChunk.Fp, _ = hex.DecodeString("000000000000")
+		zero := lineParts[0] == ubcZeroFingerprint
+		if zero {
+			switch p.zeroChunkPolicy {
+			case ZeroChunkSentinel:
+				// the fingerprint is set below, when the length of the
+				// regular fingerprints of the file is known
+				protoChunk.Zero = proto.Bool(true)
+			case ZeroChunkFlag:
+				protoChunk.Fp = append([]byte(nil), zeroChunkLegacyFp...)
+				protoChunk.Zero = proto.Bool(true)
+			default:
+				protoChunk.Fp = append([]byte(nil), zeroChunkLegacyFp...)
+			}
 		} else if fp_array, err := hex.DecodeString(lineParts[0]); err == nil {
 			protoChunk.Fp = fp_array
+			p.fpLen = len(fp_array)
 		} else {
-			log.Errorf("Couldn't decode fp %v : %v", lineParts[0], err)
+			p.fail("couldn't decode fingerprint %v: %v", lineParts[0], err)
+			return nil
 		}
 		if sz, err := strconv.ParseUint(lineParts[1], 10, 32); err != nil {
-			log.Error("Could not parse chunk size (", lineParts[2], ") in line: \n", line)
-			panic(err)
+			p.fail("couldn't parse chunk size in line %q: %v", line, err)
+			return nil
 		} else {
 			size := uint32(sz)
 			protoChunk.Csize = &size
 		}
 
-		if newbuf, err := protoChunk.Marshal(); err != nil {
-			log.Error("Couldn't marshal protobuf chunk message: ", err)
-			panic(err)
-		} else {
-			chunks = append(chunks, newbuf)
+		if zero {
+			zeroChunks++
+			zeroBytes += uint64(protoChunk.GetCsize())
+		}
+		if !zero || p.zeroChunkPolicy != ZeroChunkDrop {
+			chunks = append(chunks, protoChunk)
 		}
 
-		// cleanup and read next line
-		protoChunk.Reset()
-		line, err = p.file.ReadString('\n')
-		if err != nil {
-			log.Error("Couldn't parse chunk line")
+		// read next line. The trace may end without empty line.
+		if line, err = p.readLine(); err == io.EOF {
+			break
+		} else if err != nil {
+			p.fail("couldn't read chunk line: %v", err)
 			return nil
 		}
-		line = strings.TrimSpace(line)
 	}
 
+	if zeroChunks > 0 && p.zeroChunkPolicy == ZeroChunkSentinel {
+		n := p.fpLen
+		if n == 0 {
+			n = ubcFingerprintLen
+		}
+		for _, c := range chunks {
+			if c.GetZero() {
+				c.Fp = ZeroChunkSentinelFp(n)
+			}
+		}
+	}
+	if zeroChunks > 0 {
+		p.zeroStats.Files++
+		p.zeroStats.Chunks += uint64(zeroChunks)
+		p.zeroStats.Bytes += zeroBytes
+	}
+	if meta != nil {
+		meta.ZeroChunks = zeroChunks
+		meta.ZeroBytes = zeroBytes
+	}
 	return chunks
 }
 
@@ -148,69 +297,82 @@ func (p *UBCParser) parseFileEntry() bool {
 	var line string
 	var err error
 	// parse dirname
-	if line, err = p.file.ReadString('\n'); err == io.EOF {
+	if line, err = p.readLine(); err == io.EOF {
 		return false
 	} else if err != nil {
-		log.Error("Error while parsing file dirname: ", err)
-		panic(err)
+		return p.fail("couldn't read dirname: %v", err)
 	} else if strings.Contains(line, "LOGCOMPLETE") {
 		return false
 	}
-	line = strings.TrimSpace(line)
 	dirInfo := p.colonSeperate.FindStringSubmatch(line)
+	if dirInfo == nil {
+		return p.fail("malformed dirname line %q", line)
+	}
 
 	// parse filename
-	if line, err = p.file.ReadString('\n'); err != nil {
-		log.Error("Error while parsing filename : ", err, "\n previous line was: ", dirInfo[0])
-		panic(err)
+	if line, err = p.readLine(); err != nil {
+		return p.fail("couldn't read filename after dirname %v: %v", dirInfo[0], err)
 	}
-	line = strings.TrimSpace(line)
 	fileInfo := p.colonSeperate.FindStringSubmatch(line)
+	if fileInfo == nil {
+		return p.fail("malformed filename line %q", line)
+	}
 
 	// parse extention
-	if line, err = p.file.ReadString('\n'); err != nil {
-		log.Error("Error while parsing fileextension: ", err, "\n previous line was: ", fileInfo[0])
-		panic(err)
+	if line, err = p.readLine(); err != nil {
+		return p.fail("couldn't read file extension after filename %v: %v", fileInfo[0], err)
 	}
-	line = strings.TrimSpace(line)
 	extensionInfo := p.colonSeperate.FindStringSubmatch(line)
+	if extensionInfo == nil {
+		return p.fail("malformed file extension line %q", line)
+	}
 
-	f := new(traceProto.File)
+	ubcName, err := newUBCName(dirInfo, fileInfo, extensionInfo)
+	if err != nil {
+		return p.fail("%v", err)
+	}
 
-	name := dirInfo[1] + fileInfo[1] + extensionInfo[1]
+	f := new(traceProto.File)
+	name := ubcName.Concatenated()
+	if p.pathNames {
+		name = ubcName.Path()
+	}
 	f.Filename = proto.String(name)
-	label := extensionInfo[1]
-	f.Label = proto.String(label)
+	f.Label = proto.String(ubcName.ExtHash)
 
 	// parse file size
-	p.file.ReadString('\n')
-	if line, err = p.file.ReadString('\n'); err != nil {
-		log.Error("Error while parsing file size", err)
-		panic(err)
+	if _, err = p.readLine(); err != nil {
+		return p.fail("couldn't read line before file size: %v", err)
+	}
+	if line, err = p.readLine(); err != nil {
+		return p.fail("couldn't read file size: %v", err)
 	}
-	line = strings.TrimSpace(line)
 	if size, err := strconv.ParseUint(line, 10, 64); err != nil {
-		log.Error("Error while regex-parsing file size: ", err)
-		panic(err)
+		return p.fail("couldn't parse file size: %v", err)
 	} else {
 		f.Fsize = proto.Uint64(size)
 	}
 
-	chunks := p.parseChunks()
+	var meta *UBCFileMetadata
+	if p.metadataHandler != nil {
+		meta = &UBCFileMetadata{Filename: name, Name: ubcName}
+	}
+	chunks := p.parseChunks(meta)
+	if chunks == nil {
+		return false
+	}
 	var numChunks uint32 = uint32(len(chunks))
 	f.ChunkCount = proto.Uint32(numChunks)
 
-	// marshal and send fileobj
-	if newbuf, err := f.Marshal(); err != nil {
-		log.Error("Error while marshalling file: ", err)
-		panic(err)
-	} else {
-		p.outputChan <- newbuf
+	if meta != nil {
+		meta.parseTimes()
+		if err := p.metadataHandler(meta); err != nil {
+			return p.fail("couldn't handle file metadata: %v", err)
+		}
 	}
 
-	for _, chunk := range chunks {
-		p.outputChan <- chunk
+	if err := p.emit(f, chunks); err != nil {
+		return p.failErr(err)
 	}
-
 	return true
 }
@@ -2,6 +2,8 @@ package parser
 
 import "testing"
 import "os"
+import "io/ioutil"
+import "strings"
 import "encoding/hex"
 
 import "github.com/gogo/protobuf/proto"
@@ -11,12 +13,12 @@ func TestSkipHeader(t *testing.T) {
 	Init()
 
 	outchan := make(chan []byte)
-	ubcP := NewUBCParser("ubcTesting", outchan)
-	if ubcP == nil {
-		t.Fatal("Couldn't initialize UBCParser")
+	ubcP, err := NewUBCParser("ubcTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
 	}
 
-	ubcP.skipHeader()
+	ubcP.readHeader()
 
 	if line, err := ubcP.file.ReadString('\n'); err != nil {
 		t.Fatalf("Next line couldn't be read: %v", err)
@@ -29,9 +31,9 @@ func TestReadSingleChunk(t *testing.T) {
 	Init()
 
 	outchan := make(chan []byte)
-	ubcP := NewUBCParser("ubcTesting", outchan)
-	if ubcP == nil {
-		t.Fatal("Couldn't initialize UBCParser")
+	ubcP, err := NewUBCParser("ubcTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
 	}
 
 	for i := 0; i < 39; i++ {
@@ -39,16 +41,14 @@ func TestReadSingleChunk(t *testing.T) {
 		t.Log(line)
 	}
 
-	chunks := ubcP.parseChunks()
+	chunks := ubcP.parseChunks(nil)
 
 	if len(chunks) != 1 {
 		t.Fatalf("Wrong number of chunks. got: %v, expected: 1", len(chunks))
 	}
 
-	chunk := new(traceProto.Chunk)
-	if err := proto.Unmarshal(chunks[0], chunk); err != nil {
-		t.Fatalf("Couldn't unmarshal chunk: %v", err)
-	} else if hex := hex.EncodeToString(chunk.GetFp()); hex != "2dc83032b5" {
+	chunk := chunks[0]
+	if hex := hex.EncodeToString(chunk.GetFp()); hex != "2dc83032b5" {
 		t.Fatalf("Chunk has wrong fp: got %s, expected: 2dc83032b5", chunk.GetFp())
 	} else if chunk.GetCsize() != 204 {
 		t.Fatalf("Chunk has wrong chunkSize: got %v, expected: 204", chunk.GetCsize())
@@ -60,9 +60,9 @@ func TestReadManyChunks(t *testing.T) {
 	Init()
 	outchan := make(chan []byte)
 
-	ubcP := NewUBCParser("ubcTesting", outchan)
-	if ubcP == nil {
-		t.Fatal("Couldn't initialize UBCParser")
+	ubcP, err := NewUBCParser("ubcTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
 	}
 
 	for i := 0; i < 84; i++ {
@@ -70,20 +70,16 @@ func TestReadManyChunks(t *testing.T) {
 		t.Log(line[:len(line)-1])
 	}
 
-	chunks := ubcP.parseChunks()
+	chunks := ubcP.parseChunks(nil)
 
-	chunk := new(traceProto.Chunk)
-	if err := proto.Unmarshal(chunks[0], chunk); err != nil {
-		t.Fatalf("Couldn't unmarshal chunk: %v", err)
-	} else if hex := hex.EncodeToString(chunk.GetFp()); hex != "dea15ab313" {
+	chunk := chunks[0]
+	if hex := hex.EncodeToString(chunk.GetFp()); hex != "dea15ab313" {
 		t.Fatalf("Chunk has wrong fp: got %s, expected: dea15ab313", hex)
 	} else if chunk.GetCsize() != 8109 {
 		t.Fatalf("Chunk has wrong chunkSize: got %v, expected: 8109", chunk.GetCsize())
 	}
-	chunk = new(traceProto.Chunk)
-	if err := proto.Unmarshal(chunks[len(chunks)-1], chunk); err != nil {
-		t.Fatalf("Couldn't unmarshal chunk: %v", err)
-	} else if hex := hex.EncodeToString(chunk.GetFp()); hex != "b8013fe5ba" {
+	chunk = chunks[len(chunks)-1]
+	if hex := hex.EncodeToString(chunk.GetFp()); hex != "b8013fe5ba" {
 		t.Fatalf("Chunk has wrong fp: got %s, expected: b8013fe5ba", hex)
 	} else if chunk.GetCsize() != 3577 {
 		t.Fatalf("Chunk has wrong chunkSize: got %v, expected: 3577", chunk.GetCsize())
@@ -98,12 +94,12 @@ func TestReadFileEntry(t *testing.T) {
 	Init()
 	outchan := make(chan []byte, 10000)
 
-	ubcP := NewUBCParser("ubcTesting", outchan)
-	if ubcP == nil {
-		t.Fatal("Couldn't initialize UBCParser")
+	ubcP, err := NewUBCParser("ubcTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
 	}
 
-	ubcP.skipHeader()
+	ubcP.readHeader()
 	if !ubcP.parseFileEntry() {
 		t.Fatalf("Error during parsing file")
 	}
@@ -142,12 +138,12 @@ func TestReadManyFileEntries(t *testing.T) {
 	Init()
 	outchan := make(chan []byte, 10000)
 
-	ubcP := NewUBCParser("ubcTesting", outchan)
-	if ubcP == nil {
-		t.Fatal("Couldn't initialize UBCParser")
+	ubcP, err := NewUBCParser("ubcTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
 	}
 
-	ubcP.skipHeader()
+	ubcP.readHeader()
 	if !ubcP.parseFileEntry() {
 		t.Fatalf("Error during parsing file")
 	}
@@ -196,12 +192,14 @@ func TestReadManyFileEntries(t *testing.T) {
 func TestErrorFile(t *testing.T) {
 
 	outchan := make(chan []byte, 1e6)
-	ubcP := NewUBCParser("225", outchan)
-	if ubcP == nil {
-		t.Fatal("Couldn't initialize UBCParser")
+	ubcP, err := NewUBCParser("225", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
 	}
 
-	ubcP.ParseFile()
+	if err := ubcP.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
 	//if !ubcP.parseFileEntry() {
 	//t.Fatalf("Error during parsing file")
 	//}
@@ -237,9 +235,9 @@ func TestMixedFileEntries(t *testing.T) {
 	Init()
 	outchan := make(chan []byte, 10000)
 
-	ubcP := NewUBCParser("ubcSimpleTesting", outchan)
-	if ubcP == nil {
-		t.Fatal("Couldn't initialize UBCParser")
+	ubcP, err := NewUBCParser("ubcSimpleTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
 	}
 
 	if !ubcP.parseFileEntry() {
@@ -349,12 +347,14 @@ func TestParseFile(t *testing.T) {
 	Init()
 	outchan := make(chan []byte, 10000)
 
-	ubcP := NewUBCParser("ubcTesting", outchan)
-	if ubcP == nil {
-		t.Fatal("Couldn't initialize UBCParser")
+	ubcP, err := NewUBCParser("ubcTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
 	}
 
-	ubcP.ParseFile()
+	if err := ubcP.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
 
 	buffers := make([][]byte, 0)
 	for b := range outchan {
@@ -581,3 +581,89 @@ ae416252a6:128
 	f.Close()
 
 }
+
+func TestMalformedChunkLine(t *testing.T) {
+	Init()
+	buf, err := ioutil.ReadFile("ubcSimpleTesting")
+	if err != nil {
+		t.Fatalf("input file not available")
+	}
+	malformed := strings.Replace(string(buf), "ae416252a6:128", "ae416252a6", 1)
+	if err := ioutil.WriteFile("ubcMalformedTesting", []byte(malformed), 0666); err != nil {
+		t.Fatalf("Couldn't write test file: %v", err)
+	}
+	defer os.Remove("ubcMalformedTesting")
+
+	outchan := make(chan []byte, 10000)
+	ubcP, err := NewUBCParser("ubcMalformedTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
+	}
+
+	if !ubcP.parseFileEntry() {
+		t.Fatalf("Error during parsing first file: %v", ubcP.err)
+	}
+	if ubcP.parseFileEntry() {
+		t.Fatal("Parsing a malformed chunk line succeeded")
+	}
+
+	perr, ok := ubcP.err.(*ParseError)
+	if !ok {
+		t.Fatalf("Wrong error type: got %T", ubcP.err)
+	} else if perr.Filename != "ubcMalformedTesting" {
+		t.Fatalf("Wrong filename in error: got %v", perr.Filename)
+	} else if expected := int64(strings.Index(malformed, "ae416252a6")); perr.Offset != expected {
+		t.Fatalf("Wrong offset in error: got %v, expected: %v", perr.Offset, expected)
+	}
+}
+
+func TestMissingHeader(t *testing.T) {
+	if err := ioutil.WriteFile("ubcNoHeaderTesting", []byte("Backup Stream\n00000000005c\n"), 0666); err != nil {
+		t.Fatalf("Couldn't write test file: %v", err)
+	}
+	defer os.Remove("ubcNoHeaderTesting")
+
+	outchan := make(chan []byte, 10000)
+	ubcP, err := NewUBCParser("ubcNoHeaderTesting", outchan)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
+	}
+
+	if err := ubcP.ParseFile(); err == nil {
+		t.Fatal("Parsing a trace without header end succeeded")
+	} else if _, ok := err.(*ParseError); !ok {
+		t.Fatalf("Wrong error type: got %T", err)
+	}
+}
+
+func TestParseUBCRecords(t *testing.T) {
+	Init()
+
+	ubcP, err := NewUBCParser("ubcTesting", nil)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
+	}
+
+	recordChan := make(chan *FileEntry, 10)
+	if err := ubcP.ParseRecords(recordChan); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+
+	entries := make([]*FileEntry, 0)
+	for e := range recordChan {
+		entries = append(entries, e)
+	}
+
+	if len(entries) != 4 {
+		t.Fatalf("Wrong number of file entries: got %v, expected: 4", len(entries))
+	}
+
+	last := entries[len(entries)-1]
+	if last.File.GetFsize() != 333257 {
+		t.Fatalf("File has wrong FileSize: got %v, expected: 333257", last.File.GetFsize())
+	} else if last.File.GetChunkCount() != 46 || len(last.Chunks) != 46 {
+		t.Fatalf("File has wrong number of chunks: got %v/%v, expected: 46", last.File.GetChunkCount(), len(last.Chunks))
+	} else if hex := hex.EncodeToString(last.Chunks[45].GetFp()); hex != "b8013fe5ba" {
+		t.Fatalf("Chunk has wrong fp: got %s, expected: b8013fe5ba", hex)
+	}
+}
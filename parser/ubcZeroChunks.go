@@ -0,0 +1,64 @@
+package parser
+
+import "fmt"
+
+// The fingerprint of chunks consisting of zeros only in UBC traces.
+const ubcZeroFingerprint = "zzzzzzzzzzzz"
+
+// The policies for zero chunks of UBC traces.
+const (
+	ZeroChunkLegacy   = "legacy"   // a 6 byte all-zero fingerprint
+	ZeroChunkSentinel = "sentinel" // ZeroChunkSentinelFp of the trace's fingerprint length with Chunk.zero set
+	ZeroChunkFlag     = "flag"     // the legacy fingerprint with Chunk.zero set
+	ZeroChunkDrop     = "drop"     // the chunk is left out. File.fsize still includes it
+)
+
+// The length of regular UBC fingerprints, used for the sentinel until the
+// parser saw a regular fingerprint.
+const ubcFingerprintLen = 5
+
+// ZeroChunkSentinelFp returns the fingerprint of zero chunks of n bytes under
+// ZeroChunkSentinel: all bits set. The UBC parser uses the length of the
+// regular fingerprints of the trace, so that the sentinel doesn't stand out by
+// its length. A regular chunk whose fingerprint has all bits set as well
+// can't be told apart by its fingerprint; only Chunk.zero identifies zero
+// chunks reliably.
+func ZeroChunkSentinelFp(n int) []byte {
+	fp := make([]byte, n)
+	for i := range fp {
+		fp[i] = 0xff
+	}
+	return fp
+}
+
+// The fingerprint of zero chunks under ZeroChunkLegacy and ZeroChunkFlag.
+var zeroChunkLegacyFp = make([]byte, 6)
+
+// ZeroChunkPolicies returns the names of all zero chunk policies.
+func ZeroChunkPolicies() []string {
+	return []string{ZeroChunkLegacy, ZeroChunkSentinel, ZeroChunkFlag, ZeroChunkDrop}
+}
+
+// ZeroChunkStats counts the zero chunks of a UBC trace.
+type ZeroChunkStats struct {
+	Files  uint64 // files with at least one zero chunk
+	Chunks uint64
+	Bytes  uint64
+}
+
+// SetZeroChunkPolicy sets how the parser represents zero chunks. The default
+// is ZeroChunkLegacy.
+func (p *UBCParser) SetZeroChunkPolicy(policy string) error {
+	for _, known := range ZeroChunkPolicies() {
+		if policy == known {
+			p.zeroChunkPolicy = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown zero chunk policy %q", policy)
+}
+
+// ZeroChunkStats returns the zero chunks parsed so far.
+func (p *UBCParser) ZeroChunkStats() ZeroChunkStats {
+	return p.zeroStats
+}
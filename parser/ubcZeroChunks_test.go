@@ -0,0 +1,142 @@
+package parser
+
+import "testing"
+import "bytes"
+import "strings"
+
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+const zeroChunkTrace = `Backup Stream
+
+aaaaaaaaaa:1
+bbbbbbbbbb:2
+cccccccccc:0
+0
+350
+16
+1
+1
+0
+1
+2
+3
+zzzzzzzzzzzz:100
+1234567890:200
+zzzzzzzzzzzz:50
+
+dddddddddd:1
+eeeeeeeeee:2
+cccccccccc:0
+0
+10
+16
+1
+1
+0
+1
+2
+3
+abcdefabcd:10
+`
+
+func parseZeroChunkTrace(t *testing.T, policy string) (*UBCParser, []*FileEntry, []*UBCFileMetadata) {
+	p, err := NewUBCParserFromReader("zeroChunkTrace", strings.NewReader(zeroChunkTrace), nil)
+	if err != nil {
+		t.Fatalf("Couldn't initialize UBCParser: %v", err)
+	} else if err := p.SetZeroChunkPolicy(policy); err != nil {
+		t.Fatalf("Couldn't set policy: %v", err)
+	}
+	metadata := make([]*UBCFileMetadata, 0)
+	p.SetMetadataHandler(func(m *UBCFileMetadata) error {
+		metadata = append(metadata, m)
+		return nil
+	})
+
+	records := make(chan *FileEntry, 10)
+	if err := p.ParseRecords(records); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+	entries := make([]*FileEntry, 0)
+	for e := range records {
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Wrong number of file entries: %v", len(entries))
+	}
+	return p, entries, metadata
+}
+
+func TestZeroChunkPolicies(t *testing.T) {
+	_, entries, _ := parseZeroChunkTrace(t, ZeroChunkLegacy)
+	if c := entries[0].Chunks[0]; !bytes.Equal(c.Fp, make([]byte, 6)) || c.Zero != nil {
+		t.Fatalf("Wrong legacy zero chunk: %v", c)
+	}
+
+	// the first zero chunk precedes the first regular fingerprint
+	_, entries, _ = parseZeroChunkTrace(t, ZeroChunkSentinel)
+	if c := entries[0].Chunks[0]; !bytes.Equal(c.Fp, []byte{0xff, 0xff, 0xff, 0xff, 0xff}) || !c.GetZero() {
+		t.Fatalf("Wrong sentinel zero chunk: %v", c)
+	} else if !bytes.Equal(entries[0].Chunks[2].Fp, c.Fp) {
+		t.Fatalf("Sentinels differ: %v", entries[0].Chunks)
+	} else if entries[0].Chunks[1].GetZero() {
+		t.Fatalf("Regular chunk was flagged: %v", entries[0].Chunks[1])
+	}
+
+	// the sentinel has the length of the trace's fingerprints
+	trace := strings.NewReplacer("1234567890:", "1234567890abcdef:", "zzzzzzzzzzzz:100\n", "").Replace(zeroChunkTrace)
+	p, _ := NewUBCParserFromReader("zeroChunkTrace", strings.NewReader(trace), nil)
+	p.SetZeroChunkPolicy(ZeroChunkSentinel)
+	records := make(chan *FileEntry, 10)
+	if err := p.ParseRecords(records); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	} else if c := (<-records).Chunks[1]; !bytes.Equal(c.Fp, ZeroChunkSentinelFp(8)) || !c.GetZero() {
+		t.Fatalf("Wrong sentinel for 8 byte fingerprints: %v", c)
+	}
+
+	_, entries, _ = parseZeroChunkTrace(t, ZeroChunkFlag)
+	if c := entries[0].Chunks[0]; !c.GetZero() || entries[0].Chunks[1].GetZero() {
+		t.Fatalf("Zero chunk wasn't flagged: %v", entries[0].Chunks)
+	}
+
+	_, entries, _ = parseZeroChunkTrace(t, ZeroChunkDrop)
+	if len(entries[0].Chunks) != 1 || entries[0].File.GetChunkCount() != 1 || entries[0].Chunks[0].GetCsize() != 200 {
+		t.Fatalf("Zero chunks weren't dropped: %v", entries[0].Chunks)
+	}
+
+	p, _ = NewUBCParserFromReader("zeroChunkTrace", strings.NewReader(zeroChunkTrace), nil)
+	if err := p.SetZeroChunkPolicy("unknown"); err == nil {
+		t.Fatal("Unknown policy was accepted")
+	}
+}
+
+func TestZeroChunkStats(t *testing.T) {
+	p, _, metadata := parseZeroChunkTrace(t, ZeroChunkDrop)
+	if stats := p.ZeroChunkStats(); stats.Files != 1 || stats.Chunks != 2 || stats.Bytes != 150 {
+		t.Fatalf("Wrong stats: %+v", stats)
+	} else if metadata[0].ZeroChunks != 2 || metadata[0].ZeroBytes != 150 || metadata[1].ZeroChunks != 0 {
+		t.Fatalf("Wrong per file stats: %+v, %+v", metadata[0], metadata[1])
+	}
+}
+
+func TestZeroFlagMarshalling(t *testing.T) {
+	outchan := make(chan []byte, 100)
+	p, _ := NewUBCParserFromReader("zeroChunkTrace", strings.NewReader(zeroChunkTrace), outchan)
+	p.SetZeroChunkPolicy(ZeroChunkFlag)
+	if err := p.ParseFile(); err != nil {
+		t.Fatalf("Error during parsing: %v", err)
+	}
+
+	<-outchan // file
+	c := new(traceProto.Chunk)
+	if err := c.Unmarshal(<-outchan); err != nil {
+		t.Fatalf("Couldn't unmarshal chunk: %v", err)
+	} else if !c.GetZero() || len(c.XXX_unrecognized) != 0 {
+		t.Fatalf("Zero flag got lost: %v", c)
+	}
+	c = new(traceProto.Chunk)
+	if err := c.Unmarshal(<-outchan); err != nil {
+		t.Fatalf("Couldn't unmarshal chunk: %v", err)
+	} else if c.Zero != nil {
+		t.Fatalf("Regular chunk has zero flag: %v", c)
+	}
+}
@@ -0,0 +1,279 @@
+package parser
+
+import "os"
+import "bufio"
+import "errors"
+import "fmt"
+import "io"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// The kinds of issues reported by ValidateProtoTrace.
+const (
+	IssueChunkCount        = "chunk-count"        // File.chunkCount differs from the number of chunks that follow
+	IssueSizeMismatch      = "size-mismatch"      // the sum of Chunk.csize differs from File.fsize of a complete file
+	IssueFingerprintLength = "fingerprint-length" // a fingerprint differs in length from the first fingerprint of the trace
+	IssueTruncated         = "truncated"          // the trace ends within a message or a file entry
+	IssueUndecodable       = "undecodable"        // a message is neither a File nor a Chunk
+)
+
+// The default for ValidationOptions.MaxIssues.
+const DefaultMaxIssues = 1000
+
+// Larger messages are considered corrupt. Neither files nor chunks come
+// anywhere close to it.
+const maxMessageSize = 64 * 1024 * 1024
+
+var errCorruptSize = errors.New("corrupt message size")
+
+// ValidationIssue is a single problem found in a trace.
+type ValidationIssue struct {
+	Kind     string
+	File     int    // number of the file entry, starting at 0. -1 if before the first file
+	Filename string // File.filename of the entry
+	Offset   int64  // byte offset of the faulty message in the (decompressed) trace
+	Message  string
+}
+
+// ValidationReport summarizes a trace validation. It is meant to be encoded
+// as JSON.
+type ValidationReport struct {
+	Trace              string
+	Valid              bool
+	Truncated          bool
+	Files              uint64
+	Chunks             uint64
+	Bytes              int64            // bytes of the (decompressed) trace that were read
+	FingerprintLengths map[int]uint64   // number of chunks per fingerprint length
+	IssueCounts        map[string]int64 // number of issues per kind
+	Issues             []ValidationIssue
+	IssuesOmitted      int64 // issues not listed due to ValidationOptions.MaxIssues
+}
+
+type ValidationOptions struct {
+	MaxIssues     int  // the maximum number of issues listed in the report. All issues are counted
+	SkipSizeCheck bool // disables the size-mismatch check, e.g. for traces converted from UBC traces
+}
+
+// validator walks a trace message by message. Unlike ProtoParser it doesn't
+// trust File.chunkCount but classifies every message on its own.
+type validator struct {
+	messageReader
+	report  *ValidationReport
+	options ValidationOptions
+
+	fileNum        int
+	current        *traceProto.File
+	remaining      uint32 // chunks announced by the current file, but not yet seen
+	chunksSeen     uint32
+	chunkBytes     uint64
+	fpLength       int
+	fileOffset     int64
+	fingerprintBad bool
+}
+
+// ValidateProtoFile validates the (possibly compressed) fs-c trace at filepath.
+func ValidateProtoFile(filepath string, options ValidationOptions) (*ValidationReport, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ValidateProtoTrace(filepath, f, options)
+}
+
+// ValidateProtoTrace walks the whole fs-c trace read from r and reports all
+// inconsistencies. The returned error is only set if r couldn't be read at
+// all; problems of the trace itself are part of the report.
+func ValidateProtoTrace(name string, r io.Reader, options ValidationOptions) (*ValidationReport, error) {
+	r, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.MaxIssues <= 0 {
+		options.MaxIssues = DefaultMaxIssues
+	}
+	v := &validator{
+		report: &ValidationReport{
+			Trace:              name,
+			FingerprintLengths: make(map[int]uint64),
+			IssueCounts:        make(map[string]int64),
+		},
+		options: options,
+		fileNum: -1,
+	}
+	v.messageReader = newMessageReader(r)
+
+	if err := v.run(); err != nil {
+		return nil, err
+	}
+	v.report.Valid = len(v.report.IssueCounts) == 0
+	return v.report, nil
+}
+
+func (v *validator) issue(kind string, offset int64, format string, args ...interface{}) {
+	v.report.IssueCounts[kind]++
+	if len(v.report.Issues) >= v.options.MaxIssues {
+		v.report.IssuesOmitted++
+		return
+	}
+	v.report.Issues = append(v.report.Issues, ValidationIssue{
+		Kind:     kind,
+		File:     v.fileNum,
+		Filename: v.current.GetFilename(),
+		Offset:   offset,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) run() error {
+	for {
+		start := v.offset()
+		msg, err := v.readMessage()
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			v.report.Truncated = true
+			v.issue(IssueTruncated, start, "trace ends within a message")
+			break
+		} else if err == errCorruptSize {
+			// without a valid size the next message can't be found
+			v.issue(IssueUndecodable, start, "%v, stopped validation", err)
+			v.remaining = 0
+			break
+		} else if err != nil {
+			return err
+		}
+
+		f, c := classify(msg)
+		switch {
+		case f != nil:
+			if v.remaining > 0 {
+				v.issue(IssueChunkCount, start, "file announces %v chunks, but only %v follow", v.current.GetChunkCount(), v.chunksSeen)
+			}
+			v.finishFile()
+			v.startFile(f, start)
+		case c != nil:
+			if v.current == nil || v.remaining == 0 {
+				v.issue(IssueChunkCount, start, "chunk %v exceeds the %v announced chunks", v.chunksSeen, v.current.GetChunkCount())
+			} else {
+				v.remaining--
+			}
+			v.addChunk(c, start)
+		default:
+			v.issue(IssueUndecodable, start, "message of %v bytes is neither a File nor a Chunk", len(msg))
+			if v.remaining > 0 { // most likely a broken chunk
+				v.remaining--
+				v.chunksSeen++
+			}
+		}
+	}
+
+	if v.remaining > 0 {
+		v.report.Truncated = true
+		v.issue(IssueTruncated, v.offset(), "trace ends after %v of %v announced chunks", v.chunksSeen, v.current.GetChunkCount())
+	}
+	v.finishFile()
+	v.report.Bytes = v.offset()
+	return nil
+}
+
+// classify decodes msg either as File or as Chunk. Both are nil if msg is
+// neither.
+func classify(msg []byte) (*traceProto.File, *traceProto.Chunk) {
+	f := new(traceProto.File)
+	if err := f.Unmarshal(msg); err == nil && (f.Filename != nil || f.ChunkCount != nil) && len(f.XXX_unrecognized) == 0 {
+		return f, nil
+	}
+	c := new(traceProto.Chunk)
+	if err := c.Unmarshal(msg); err == nil && c.Fp != nil && len(c.XXX_unrecognized) == 0 {
+		return nil, c
+	}
+	return nil, nil
+}
+
+func (v *validator) startFile(f *traceProto.File, offset int64) {
+	v.fileNum++
+	v.report.Files++
+	v.current = f
+	v.remaining = f.GetChunkCount()
+	v.chunksSeen = 0
+	v.chunkBytes = 0
+	v.fileOffset = offset
+	v.fingerprintBad = false
+}
+
+func (v *validator) addChunk(c *traceProto.Chunk, offset int64) {
+	v.report.Chunks++
+	v.chunksSeen++
+	v.chunkBytes += uint64(c.GetCsize())
+	v.report.FingerprintLengths[len(c.Fp)]++
+
+	if v.fpLength == 0 {
+		v.fpLength = len(c.Fp)
+	} else if len(c.Fp) != v.fpLength && !v.fingerprintBad {
+		// reported once per file
+		v.fingerprintBad = true
+		v.issue(IssueFingerprintLength, offset, "fingerprint of chunk %v has %v bytes instead of %v", v.chunksSeen-1, len(c.Fp), v.fpLength)
+	}
+}
+
+func (v *validator) finishFile() {
+	if v.current == nil || v.current.GetPartial() || v.remaining > 0 || v.options.SkipSizeCheck {
+		return
+	}
+	if v.chunkBytes != v.current.GetFsize() {
+		v.issue(IssueSizeMismatch, v.fileOffset, "chunks sum up to %v bytes, but the file has %v bytes", v.chunkBytes, v.current.GetFsize())
+	}
+}
+
+// messageReader reads varint-delimited messages without interpreting them.
+type messageReader struct {
+	file    *bufio.Reader
+	counter *countingReader
+}
+
+func newMessageReader(r io.Reader) messageReader {
+	counter := &countingReader{r: r}
+	return messageReader{file: bufio.NewReaderSize(counter, 4*1024*1024), counter: counter}
+}
+
+// offset returns the number of bytes consumed so far.
+func (m *messageReader) offset() int64 {
+	return m.counter.n - int64(m.file.Buffered())
+}
+
+// readMessage reads the next varint-delimited message. Returns io.EOF at the
+// end of the trace and io.ErrUnexpectedEOF if the trace ends within a message.
+func (m *messageReader) readMessage() ([]byte, error) {
+	buf := make([]byte, 0, 10)
+	var size uint64
+	for {
+		b, err := m.file.ReadByte()
+		if err == io.EOF && len(buf) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b)
+		if n, consumed := proto.DecodeVarint(buf); consumed != 0 {
+			size = n
+			break
+		} else if len(buf) == cap(buf) {
+			return nil, errCorruptSize
+		}
+	}
+	if size > maxMessageSize {
+		return nil, errCorruptSize
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(m.file, msg); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
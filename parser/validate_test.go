@@ -0,0 +1,135 @@
+package parser
+
+import "testing"
+import "bytes"
+
+import "github.com/gogo/protobuf/proto"
+import "github.com/jkaiser/dedup_tools/traceProto"
+
+// writes a file entry with the given chunk sizes, but announces chunkCount chunks
+func writeValidationEntry(buf *bytes.Buffer, name string, chunkCount uint32, sizes ...uint32) {
+	var fsize uint64
+	for _, s := range sizes {
+		fsize += uint64(s)
+	}
+	f := &traceProto.File{Filename: proto.String(name), Fsize: proto.Uint64(fsize), ChunkCount: proto.Uint32(chunkCount)}
+	fbuf, _ := f.Marshal()
+	buf.Write(proto.EncodeVarint(uint64(len(fbuf))))
+	buf.Write(fbuf)
+
+	for i, s := range sizes {
+		c := &traceProto.Chunk{Fp: make([]byte, 20), Csize: proto.Uint32(s)}
+		c.Fp[0] = byte(i)
+		cbuf, _ := c.Marshal()
+		buf.Write(proto.EncodeVarint(uint64(len(cbuf))))
+		buf.Write(cbuf)
+	}
+}
+
+func validate(t *testing.T, trace []byte, options ValidationOptions) *ValidationReport {
+	report, err := ValidateProtoTrace("test", bytes.NewReader(trace), options)
+	if err != nil {
+		t.Fatalf("Error during validation: %v", err)
+	}
+	return report
+}
+
+func TestValidateValidTrace(t *testing.T) {
+	var buf bytes.Buffer
+	writeValidationEntry(&buf, "a", 2, 10, 20)
+	writeValidationEntry(&buf, "b", 0)
+	writeValidationEntry(&buf, "c", 1, 30)
+
+	report := validate(t, buf.Bytes(), ValidationOptions{})
+	if !report.Valid {
+		t.Fatalf("Valid trace was reported as invalid: %+v", report)
+	} else if report.Files != 3 || report.Chunks != 3 {
+		t.Fatalf("Wrong counts: %v files, %v chunks", report.Files, report.Chunks)
+	} else if report.Bytes != int64(buf.Len()) {
+		t.Fatalf("Wrong number of bytes: got %v, expected: %v", report.Bytes, buf.Len())
+	} else if report.FingerprintLengths[20] != 3 {
+		t.Fatalf("Wrong fingerprint lengths: %v", report.FingerprintLengths)
+	}
+}
+
+func TestValidateChunkCount(t *testing.T) {
+	var buf bytes.Buffer
+	writeValidationEntry(&buf, "a", 3, 10, 20) // one chunk too few
+	writeValidationEntry(&buf, "b", 1, 10, 20) // one chunk too many
+
+	report := validate(t, buf.Bytes(), ValidationOptions{SkipSizeCheck: true})
+	if report.Valid {
+		t.Fatal("Invalid trace was reported as valid")
+	} else if report.IssueCounts[IssueChunkCount] != 2 {
+		t.Fatalf("Wrong number of chunk count issues: %+v", report.Issues)
+	} else if report.Issues[0].File != 0 || report.Issues[0].Filename != "a" {
+		t.Fatalf("Wrong file in first issue: %+v", report.Issues[0])
+	} else if report.Issues[1].File != 1 || report.Issues[1].Filename != "b" {
+		t.Fatalf("Wrong file in second issue: %+v", report.Issues[1])
+	} else if report.Files != 2 || report.Chunks != 4 {
+		t.Fatalf("Wrong counts: %v files, %v chunks", report.Files, report.Chunks)
+	}
+}
+
+func TestValidateSizeAndFingerprints(t *testing.T) {
+	var buf bytes.Buffer
+	f := &traceProto.File{Filename: proto.String("a"), Fsize: proto.Uint64(100), ChunkCount: proto.Uint32(2)}
+	fbuf, _ := f.Marshal()
+	buf.Write(proto.EncodeVarint(uint64(len(fbuf))))
+	buf.Write(fbuf)
+	for _, fpLen := range []int{20, 6} {
+		c := &traceProto.Chunk{Fp: make([]byte, fpLen), Csize: proto.Uint32(10)}
+		cbuf, _ := c.Marshal()
+		buf.Write(proto.EncodeVarint(uint64(len(cbuf))))
+		buf.Write(cbuf)
+	}
+
+	report := validate(t, buf.Bytes(), ValidationOptions{})
+	if report.IssueCounts[IssueSizeMismatch] != 1 {
+		t.Fatalf("Size mismatch wasn't reported: %+v", report.Issues)
+	} else if report.IssueCounts[IssueFingerprintLength] != 1 {
+		t.Fatalf("Fingerprint length wasn't reported: %+v", report.Issues)
+	}
+
+	report = validate(t, buf.Bytes(), ValidationOptions{SkipSizeCheck: true})
+	if report.IssueCounts[IssueSizeMismatch] != 0 {
+		t.Fatalf("Size mismatch was reported despite SkipSizeCheck: %+v", report.Issues)
+	}
+}
+
+func TestValidateTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	writeValidationEntry(&buf, "a", 2, 10, 20)
+	full := buf.Len()
+	writeValidationEntry(&buf, "b", 2, 10, 20)
+
+	// ends within the last chunk
+	report := validate(t, buf.Bytes()[:buf.Len()-3], ValidationOptions{})
+	if !report.Truncated || report.IssueCounts[IssueTruncated] != 2 {
+		t.Fatalf("Truncation wasn't reported correctly: %+v", report)
+	} else if report.Files != 2 || report.Chunks != 3 {
+		t.Fatalf("Wrong counts: %v files, %v chunks", report.Files, report.Chunks)
+	}
+
+	// ends after a complete file entry
+	report = validate(t, buf.Bytes()[:full], ValidationOptions{})
+	if !report.Valid {
+		t.Fatalf("Complete prefix was reported as invalid: %+v", report)
+	}
+}
+
+func TestValidateUndecodable(t *testing.T) {
+	var buf bytes.Buffer
+	writeValidationEntry(&buf, "a", 2, 10)
+	buf.Write([]byte{3, 0xff, 0xff, 0xff})
+	writeValidationEntry(&buf, "b", 0)
+
+	report := validate(t, buf.Bytes(), ValidationOptions{MaxIssues: 1})
+	if report.IssueCounts[IssueUndecodable] != 1 {
+		t.Fatalf("Undecodable message wasn't reported: %+v", report)
+	} else if report.Files != 2 {
+		t.Fatalf("Validation didn't continue after undecodable message: %+v", report)
+	} else if len(report.Issues) != 1 {
+		t.Fatalf("MaxIssues wasn't respected: %+v", report.Issues)
+	}
+}
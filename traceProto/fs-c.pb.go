@@ -90,7 +90,9 @@ type Chunk struct {
 	Fp    []byte  `protobuf:"bytes,2,opt,name=fp" json:"fp,omitempty"`
 	Csize *uint32 `protobuf:"varint,3,opt,name=csize" json:"csize,omitempty"`
 	// value of a rabin fingerprinter when the chunk was accepted. May not be set
-	ChunkHash        *int64 `protobuf:"varint,4,opt,name=chunkHash" json:"chunkHash,omitempty"`
+	ChunkHash *int64 `protobuf:"varint,4,opt,name=chunkHash" json:"chunkHash,omitempty"`
+	// set if the chunk consists of zeros only, e.g. the zero chunks of UBC traces. May not be set
+	Zero             *bool  `protobuf:"varint,5,opt,name=zero,def=0" json:"zero,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
 }
 
@@ -98,6 +100,8 @@ func (m *Chunk) Reset()         { *m = Chunk{} }
 func (m *Chunk) String() string { return proto.CompactTextString(m) }
 func (*Chunk) ProtoMessage()    {}
 
+const Default_Chunk_Zero bool = false
+
 func (m *Chunk) GetFp() []byte {
 	if m != nil {
 		return m.Fp
@@ -119,6 +123,13 @@ func (m *Chunk) GetChunkHash() int64 {
 	return 0
 }
 
+func (m *Chunk) GetZero() bool {
+	if m != nil && m.Zero != nil {
+		return *m.Zero
+	}
+	return Default_Chunk_Zero
+}
+
 func init() {
 }
 func (m *File) Unmarshal(data []byte) error {
@@ -359,6 +370,24 @@ func (m *Chunk) Unmarshal(data []byte) error {
 				}
 			}
 			m.ChunkHash = &v
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Zero", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			b := bool(v != 0)
+			m.Zero = &b
 		default:
 			var sizeOfWire int
 			for {
@@ -425,6 +454,9 @@ func (m *Chunk) Size() (n int) {
 	if m.ChunkHash != nil {
 		n += 1 + sovFsC(uint64(*m.ChunkHash))
 	}
+	if m.Zero != nil {
+		n += 2
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -534,6 +566,16 @@ func (m *Chunk) MarshalTo(data []byte) (n int, err error) {
 		i++
 		i = encodeVarintFsC(data, i, uint64(*m.ChunkHash))
 	}
+	if m.Zero != nil {
+		data[i] = 0x28
+		i++
+		if *m.Zero {
+			data[i] = 1
+		} else {
+			data[i] = 0
+		}
+		i++
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}